@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+/*
+ * Attributes hold any extra fields supplied by inputs such as GELF which
+ * do not correspond to a LogItem field, as strings. Mongo field names may
+ * not contain '.' or start with '$', so such characters in names are
+ * replaced with '_'.
+ *
+ * Attributes may be queried with keys of the form "attributes.NAME".
+ */
+
+const attributeQueryPrefix = "attributes."
+
+func attributeName(name string) string {
+	name = strings.Replace(name, ".", "_", -1)
+	if strings.HasPrefix(name, "$") {
+		name = "_" + name[1:]
+	}
+	return name
+}
+
+func (l *LogItem) setAttribute(name string, value string) {
+	if name == "" {
+		return
+	}
+	if l.Attributes == nil {
+		l.Attributes = make(map[string]string)
+	}
+	l.Attributes[attributeName(name)] = value
+}
+
+// The string form of a decoded JSON value; objects and arrays are kept as JSON
+func attributeString(v interface{}) string {
+	switch t := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(t)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// Translate an "attributes.NAME" query key into the database field name
+func attributeQueryKey(k string) (string, bool) {
+	if !strings.HasPrefix(k, attributeQueryPrefix) || len(k) == len(attributeQueryPrefix) {
+		return "", false
+	}
+	return "attributes." + attributeName(strings.TrimPrefix(k, attributeQueryPrefix)), true
+}
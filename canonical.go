@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/fatih/structs"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * Canonical encoding of log items (used by format version 3)
+ *
+ * Format versions 1 and 2 hash each field's value as raw text separated
+ * by zero bytes, which is ambiguous. Format version 3 instead hashes the
+ * following unambiguous encoding, keyed as HMAC-SHA256 with the hash
+ * secret. It is intended to be simple to reimplement in an independent
+ * verifier working from exported (JSON) items.
+ *
+ * All integers are big endian. A 'string' is a u32 byte length followed by
+ * that many bytes of UTF-8.
+ *
+ *   preimage = magic version field*
+ *   magic    = the 17 bytes "slogger-canonical" followed by a zero byte
+ *   version  = u8, the encoding version, currently 1
+ *   field    = name tag value
+ *   name     = string, the JSON name of the field
+ *
+ * Fields appear in ascending byte order of their JSON names. Every field
+ * is hashed except 'hash' and 'verified'. A field whose value is the zero
+ * value for its type (empty string, 0, the zero time, or no structured
+ * data or attributes) is omitted entirely; as the field name is encoded
+ * this is unambiguous, and it means adding new fields does not change the
+ * hash of existing items.
+ *
+ *   tag  value
+ *   0x01 string
+ *   0x02 i64, two's complement integer
+ *   0x03 i64, time as nanoseconds since the unix epoch (UTC). Times are
+ *        stored to the millisecond, so this is always a multiple of 10^6
+ *   0x04 u8, boolean, 1 for true
+ *   0x05 structured data: a u32 count of elements, then for each element
+ *        its id as a string, a u32 count of params, and for each param its
+ *        name then its value as strings, all in the order received
+ *   0x06 string map: a u32 count of entries, then for each entry in
+ *        ascending byte order of key, its key then its value as strings
+ *
+ * The fields, in order, and their tags are currently:
+ *
+ *   account_group_id 0x01, app_name 0x01, attributes 0x06, client_name 0x01,
+ *   exception 0x01, facility 0x01, format_version 0x02, hostname 0x01,
+ *   instance_id 0x01, key_id 0x01, level 0x01, level_no 0x02, message 0x01,
+ *   msg_id 0x01, originator_ip 0x01, originator_port 0x02, pid 0x02,
+ *   previous_hash 0x01, proc_id 0x01, sequence_id 0x02, shard_group 0x02,
+ *   span_id 0x01, structured_data 0x05, time 0x03, timestamp 0x03,
+ *   trace_id 0x01, user 0x01
+ */
+
+const (
+	canonicalMagic   = "slogger-canonical\x00"
+	canonicalVersion = 1
+)
+
+const (
+	canonicalTagString = 0x01
+	canonicalTagInt    = 0x02
+	canonicalTagTime   = 0x03
+	canonicalTagBool   = 0x04
+	canonicalTagSD     = 0x05
+	canonicalTagMap    = 0x06
+)
+
+// Field names in canonical order (i.e. ordered by JSON name)
+var canonicalFieldList []string
+
+func initCanonicalFields() {
+	canonicalFieldList = nil
+	for _, k := range logItemFieldList {
+		if !hasFieldProperty(k, fpNoHash) {
+			canonicalFieldList = append(canonicalFieldList, k)
+		}
+	}
+	sort.Slice(canonicalFieldList, func(i, j int) bool {
+		return logItemFields[strings.ToLower(canonicalFieldList[i])].jsonName < logItemFields[strings.ToLower(canonicalFieldList[j])].jsonName
+	})
+}
+
+type canonicalEncoder struct {
+	b bytes.Buffer
+}
+
+func (e *canonicalEncoder) writeUint32(v uint32) {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	e.b.Write(buf[:])
+}
+
+func (e *canonicalEncoder) writeInt64(v int64) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(v))
+	e.b.Write(buf[:])
+}
+
+func (e *canonicalEncoder) writeString(s string) {
+	e.writeUint32(uint32(len(s)))
+	e.b.WriteString(s)
+}
+
+func (e *canonicalEncoder) writeField(name string, tag byte) {
+	e.writeString(name)
+	e.b.WriteByte(tag)
+}
+
+// The canonical encoding of a log item as described above
+func (l *LogItem) canonicalHashFields() []byte {
+	var e canonicalEncoder
+	e.b.WriteString(canonicalMagic)
+	e.b.WriteByte(canonicalVersion)
+	str := structs.New(l)
+	for _, k := range canonicalFieldList {
+		v, ok := str.FieldOk(k)
+		if !ok {
+			continue
+		}
+		name := logItemFields[strings.ToLower(k)].jsonName
+		switch t := v.Value().(type) {
+		case string:
+			if t != "" {
+				e.writeField(name, canonicalTagString)
+				e.writeString(t)
+			}
+		case int:
+			if t != 0 {
+				e.writeField(name, canonicalTagInt)
+				e.writeInt64(int64(t))
+			}
+		case int64:
+			if t != 0 {
+				e.writeField(name, canonicalTagInt)
+				e.writeInt64(t)
+			}
+		case time.Time:
+			if !t.IsZero() {
+				e.writeField(name, canonicalTagTime)
+				e.writeInt64(t.UnixNano())
+			}
+		case bool:
+			if t {
+				e.writeField(name, canonicalTagBool)
+				e.b.WriteByte(1)
+			}
+		case map[string]string:
+			if len(t) > 0 {
+				keys := make([]string, 0, len(t))
+				for k := range t {
+					keys = append(keys, k)
+				}
+				sort.Strings(keys)
+				e.writeField(name, canonicalTagMap)
+				e.writeUint32(uint32(len(keys)))
+				for _, k := range keys {
+					e.writeString(k)
+					e.writeString(t[k])
+				}
+			}
+		case []SDElement:
+			if len(t) > 0 {
+				e.writeField(name, canonicalTagSD)
+				e.writeUint32(uint32(len(t)))
+				for _, el := range t {
+					e.writeString(el.Id)
+					e.writeUint32(uint32(len(el.Params)))
+					for _, p := range el.Params {
+						e.writeString(p.Name)
+						e.writeString(p.Value)
+					}
+				}
+			}
+		default:
+			log.Panicf("Cannot canonically encode %s", k)
+		}
+	}
+	return e.b.Bytes()
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"sort"
+	"time"
+)
+
+// The maximum number of problems itemised in a chain report. Beyond this
+// problems are still counted but not listed
+const maxReportEntries = 1000
+
+type sequenceRange struct {
+	From int64 `json:"from"`
+	To   int64 `json:"to"`
+}
+
+/*
+ * A chainReport describes the result of walking a shard group's chain
+ * in SequenceId order, checking both each item's own hash and that its
+ * PreviousHash matches the hash of the item at SequenceId-1
+ */
+type chainReport struct {
+	ShardGroup  int             `json:"shard_group"`
+	From        int64           `json:"from"`
+	To          int64           `json:"to"`
+	Count       int             `json:"count"`
+	First       int64           `json:"first_sequence_id"`
+	Last        int64           `json:"last_sequence_id"`
+	Intact      bool            `json:"intact"`
+	Problems    int             `json:"problems"`
+	Truncated   bool            `json:"truncated"`
+	Gaps        []sequenceRange `json:"gaps"`
+	Duplicates  []int64         `json:"duplicates"`
+	BrokenLinks []int64         `json:"broken_links"`
+	BadHashes   []int64         `json:"bad_hashes"`
+	UnknownKeys []int64         `json:"unknown_keys"`
+}
+
+// chainVerifier accumulates a chainReport from items supplied in SequenceId order
+type chainVerifier struct {
+	report       *chainReport
+	havePrevious bool
+	previous     LogItem
+}
+
+func newChainVerifier(shardGroup int, from int64, to int64) *chainVerifier {
+	return &chainVerifier{
+		report: &chainReport{
+			ShardGroup:  shardGroup,
+			From:        from,
+			To:          to,
+			First:       -1,
+			Last:        -1,
+			Gaps:        []sequenceRange{},
+			Duplicates:  []int64{},
+			BrokenLinks: []int64{},
+			BadHashes:   []int64{},
+			UnknownKeys: []int64{},
+		},
+	}
+}
+
+func (v *chainVerifier) problem() bool {
+	v.report.Problems++
+	if v.report.Problems > maxReportEntries {
+		v.report.Truncated = true
+		return false
+	}
+	return true
+}
+
+func (v *chainVerifier) gap(from int64, to int64) {
+	if v.problem() {
+		v.report.Gaps = append(v.report.Gaps, sequenceRange{From: from, To: to})
+	}
+}
+
+// seed supplies the item immediately before the range being verified, so that
+// the link from the first item in the range can be checked
+func (v *chainVerifier) seed(l *LogItem) {
+	v.previous = *l
+	v.havePrevious = true
+}
+
+// missingPredecessor records that the item immediately before the range
+// being verified does not exist, so the link from the first item cannot be
+// checked
+func (v *chainVerifier) missingPredecessor() {
+	v.gap(v.report.From-1, v.report.From-1)
+}
+
+func (v *chainVerifier) add(l *LogItem) {
+	v.addChecked(l, l.checkHash())
+}
+
+// As add, but where the caller has already checked the item's own hash
+func (v *chainVerifier) addChecked(l *LogItem, hashErr error) {
+	r := v.report
+	if r.Count == 0 {
+		r.First = l.SequenceId
+	}
+	r.Count++
+	r.Last = l.SequenceId
+
+	switch {
+	case hashErr == errUnknownHashKey:
+		if v.problem() {
+			r.UnknownKeys = append(r.UnknownKeys, l.SequenceId)
+		}
+	case hashErr != nil:
+		if v.problem() {
+			r.BadHashes = append(r.BadHashes, l.SequenceId)
+		}
+	}
+
+	if !v.havePrevious {
+		if l.SequenceId > r.From {
+			v.gap(r.From, l.SequenceId-1)
+		} else if l.SequenceId == 0 && l.PreviousHash != "" && v.problem() {
+			// The first item in a chain must not claim a predecessor
+			r.BrokenLinks = append(r.BrokenLinks, l.SequenceId)
+		}
+	} else {
+		switch {
+		case l.SequenceId == v.previous.SequenceId:
+			if v.problem() {
+				r.Duplicates = append(r.Duplicates, l.SequenceId)
+			}
+			// Keep the first of the duplicates as the predecessor
+			return
+		case l.SequenceId > v.previous.SequenceId+1:
+			v.gap(v.previous.SequenceId+1, l.SequenceId-1)
+		case l.PreviousHash != v.previous.Hash:
+			if v.problem() {
+				r.BrokenLinks = append(r.BrokenLinks, l.SequenceId)
+			}
+		}
+	}
+	v.previous = *l
+	v.havePrevious = true
+}
+
+func (v *chainVerifier) finish() *chainReport {
+	r := v.report
+	switch {
+	case r.Count == 0 && r.To >= r.From:
+		v.gap(r.From, r.To)
+	case r.Count > 0 && r.To >= 0 && r.Last < r.To:
+		// The chain stops short of the end of the range
+		v.gap(r.Last+1, r.To)
+	}
+	r.Intact = r.Problems == 0
+	return r
+}
+
+// Walk the chain for a shard group from sequence id 'from' to 'to' inclusive
+// (a negative 'to' means the end of the chain) and report on its integrity,
+// including the link from the item before 'from'. If that item is missing
+// it is reported as a gap.
+func verifyChain(db *Database, shardGroup int, from int64, to int64) *chainReport {
+	start := time.Now()
+	sessionCopy := db.mongoSession.Copy()
+	defer func() {
+		sessionCopy.Close()
+		log.Printf("Time to verify = %s\n", time.Since(start))
+	}()
+
+	c := db.getLogItemCollection(sessionCopy)
+	v := newChainVerifier(shardGroup, from, to)
+
+	if from > 0 {
+		var previous LogItem
+		if err := c.Find(bson.M{"shardgroup": shardGroup, "sequenceid": from - 1}).One(&previous); err == nil {
+			v.seed(&previous)
+		} else if err == mgo.ErrNotFound {
+			v.missingPredecessor()
+		} else {
+			log.Panicf("Query returned error %v\n", err)
+		}
+	}
+
+	seqQuery := bson.M{"$gte": from}
+	if to >= 0 {
+		seqQuery["$lte"] = to
+	}
+	iter := c.Find(bson.M{"shardgroup": shardGroup, "sequenceid": seqQuery}).Sort("sequenceid", "_id").Iter()
+	defer iter.Close()
+
+	var result LogItem
+	for iter.Next(&result) {
+		v.add(&result)
+	}
+	if err := iter.Err(); err != nil {
+		log.Panicf("Error while iterating: %v\n", err)
+	}
+	return v.finish()
+}
+
+// resultChecker reports on the chain completeness of query results, which
+// may arrive in any order and from several shard groups
+type resultChecker struct {
+	results  map[int][]checkedItem
+	expected map[int]sequenceRange
+}
+
+// The chain fields of a result and the outcome of checking its hash
+type checkedItem struct {
+	item    LogItem
+	hashErr error
+}
+
+func newResultChecker() *resultChecker {
+	return &resultChecker{results: make(map[int][]checkedItem), expected: make(map[int]sequenceRange)}
+}
+
+// Expect the results to cover a given range of a shard group's chain (a
+// negative 'to' meaning the end of the chain), rather than just the range
+// between the first and last results
+func (rc *resultChecker) expect(shardGroup int, from int64, to int64) {
+	rc.expected[shardGroup] = sequenceRange{From: from, To: to}
+}
+
+// Record the chain fields of a result, and the outcome of checking its hash
+func (rc *resultChecker) add(l *LogItem, hashErr error) {
+	rc.results[l.ShardGroup] = append(rc.results[l.ShardGroup], checkedItem{
+		item: LogItem{
+			ShardGroup:   l.ShardGroup,
+			SequenceId:   l.SequenceId,
+			Hash:         l.Hash,
+			PreviousHash: l.PreviousHash,
+		},
+		hashErr: hashErr,
+	})
+}
+
+// A report per shard group on whether the results form a contiguous,
+// verified range of its chain
+func (rc *resultChecker) finish() []*chainReport {
+	shardGroups := make([]int, 0, len(rc.results))
+	for sg := range rc.results {
+		shardGroups = append(shardGroups, sg)
+	}
+	for sg := range rc.expected {
+		if _, ok := rc.results[sg]; !ok {
+			shardGroups = append(shardGroups, sg)
+		}
+	}
+	sort.Ints(shardGroups)
+
+	reports := []*chainReport{}
+	for _, sg := range shardGroups {
+		items := rc.results[sg]
+		sort.Slice(items, func(i, j int) bool { return items[i].item.SequenceId < items[j].item.SequenceId })
+		var v *chainVerifier
+		if r, ok := rc.expected[sg]; ok {
+			v = newChainVerifier(sg, r.From, r.To)
+		} else {
+			v = newChainVerifier(sg, items[0].item.SequenceId, items[len(items)-1].item.SequenceId)
+		}
+		for i := range items {
+			v.addChecked(&items[i].item, items[i].hashErr)
+		}
+		reports = append(reports, v.finish())
+	}
+	return reports
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/abligh/cdl"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ * Truncation detection. If the newest items of a shard group are deleted,
+ * the chain would otherwise silently continue from whatever is now the
+ * last item. To detect this we record the head of each shard group after
+ * every insert in an append-only local file (and optionally a Mongo
+ * collection), and check at startup and on each insert that the database
+ * still holds the recorded head.
+ *
+ * The head file has one JSON object per line; the last line for a shard
+ * group is its recorded head.
+ */
+
+var headMismatchEnum = cdl.NewEnumType("refuse", "alarm")
+
+var (
+	headFilePath       string
+	headCollName       string
+	headMismatchAction = headMismatchEnum.New("refuse")
+)
+
+type chainHead struct {
+	ShardGroup int       `json:"shard_group" bson:"_id"`
+	SequenceId int64     `json:"sequence_id"`
+	Hash       string    `json:"hash"`
+	Time       time.Time `json:"time"`
+}
+
+var (
+	chainHeadMutex sync.Mutex
+	chainHeads     map[int]chainHead
+	headFile       *os.File
+)
+
+func chainHeadsEnabled() bool {
+	return headFilePath != "" || headCollName != ""
+}
+
+func (db *Database) getHeadCollection(s *mgo.Session) *mgo.Collection {
+	return s.DB(databaseName).C(headCollName)
+}
+
+func loadChainHeadFile() {
+	f, err := os.Open(headFilePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return
+		}
+		log.Fatalf("Cannot open head file %s: %v", headFilePath, err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		var h chainHead
+		if err := json.Unmarshal(scanner.Bytes(), &h); err != nil {
+			// Most likely a write interrupted by a crash
+			log.Printf("Ignoring bad line %d in head file %s: %v\n", line, headFilePath, err)
+			continue
+		}
+		chainHeads[h.ShardGroup] = h
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("Cannot read head file %s: %v", headFilePath, err)
+	}
+}
+
+// Load the recorded heads and check them against the database. Where both
+// a file and a collection are configured, the furthest head wins.
+func startChainHeads(db *Database) {
+	if !chainHeadsEnabled() {
+		return
+	}
+	chainHeads = make(map[int]chainHead)
+
+	sessionCopy := db.mongoSession.Copy()
+	defer sessionCopy.Close()
+
+	if headFilePath != "" {
+		loadChainHeadFile()
+		var err error
+		if headFile, err = os.OpenFile(headFilePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+			log.Fatalf("Cannot open head file %s: %v", headFilePath, err)
+		}
+	}
+	if headCollName != "" {
+		var heads []chainHead
+		if err := db.getHeadCollection(sessionCopy).Find(nil).All(&heads); err != nil {
+			log.Fatalf("Cannot read chain heads: %v", err)
+		}
+		for _, h := range heads {
+			if old, ok := chainHeads[h.ShardGroup]; !ok || old.SequenceId < h.SequenceId {
+				chainHeads[h.ShardGroup] = h
+			}
+		}
+	}
+
+	c := db.getLogItemCollection(sessionCopy)
+	for sg, h := range chainHeads {
+		if msg, ok := checkChainHeadPresent(c, h); !ok {
+			if headMismatchAction.String() == "refuse" {
+				log.Fatalf("Refusing to start: shard group %d %s", sg, msg)
+			}
+			chainHeadAlarm(sg, msg)
+		}
+	}
+	log.Printf("Checked %d recorded chain heads\n", len(chainHeads))
+}
+
+// Check the database still has the recorded head item unchanged
+func checkChainHeadPresent(c *mgo.Collection, h chainHead) (string, bool) {
+	var item LogItem
+	if err := c.Find(bson.M{"shardgroup": h.ShardGroup, "sequenceid": h.SequenceId}).Select(bson.M{"hash": 1}).One(&item); err != nil {
+		if err != mgo.ErrNotFound {
+			log.Panicf("Query returned error %v\n", err)
+		}
+		return fmt.Sprintf("has lost its recorded head at sequence id %d (%s)", h.SequenceId, h.Hash), false
+	}
+	if item.Hash != h.Hash {
+		return fmt.Sprintf("has changed its recorded head at sequence id %d from %s to %s", h.SequenceId, h.Hash, item.Hash), false
+	}
+	return "", true
+}
+
+// Raise an alarm, and forget the recorded head so the chain can continue
+func chainHeadAlarm(shardGroup int, msg string) {
+	log.Printf("ALARM: chain for shard group %d %s\n", shardGroup, msg)
+	chainHeadMutex.Lock()
+	defer chainHeadMutex.Unlock()
+	delete(chainHeads, shardGroup)
+}
+
+/*
+ * Check whether an item may be inserted at a given sequence id. If that is
+ * at or behind the recorded head, either the database has been truncated or
+ * someone else has inserted since the caller read the head of the chain. In
+ * the latter case we return false and the caller should re-read the head.
+ */
+func checkChainHead(c *mgo.Collection, shardGroup int, sequenceId int64) bool {
+	if !chainHeadsEnabled() {
+		return true
+	}
+	chainHeadMutex.Lock()
+	h, ok := chainHeads[shardGroup]
+	chainHeadMutex.Unlock()
+	if !ok || h.SequenceId < sequenceId {
+		return true
+	}
+	if _, ok := checkChainHeadPresent(c, h); ok {
+		return false
+	}
+	msg := fmt.Sprintf("is behind its recorded head at sequence id %d (%s)", h.SequenceId, h.Hash)
+	if headMismatchAction.String() == "refuse" {
+		log.Panicf("Refusing to insert: chain for shard group %d %s", shardGroup, msg)
+	}
+	chainHeadAlarm(shardGroup, msg)
+	return true
+}
+
+// Record the new head of a chain after an insert
+func recordChainHead(db *Database, s *mgo.Session, l *LogItem) {
+	if !chainHeadsEnabled() {
+		return
+	}
+	chainHeadMutex.Lock()
+	defer chainHeadMutex.Unlock()
+	if h, ok := chainHeads[l.ShardGroup]; ok && h.SequenceId >= l.SequenceId {
+		// A concurrent insert has already recorded a later head
+		return
+	}
+	h := chainHead{ShardGroup: l.ShardGroup, SequenceId: l.SequenceId, Hash: l.Hash, Time: time.Now()}
+	chainHeads[l.ShardGroup] = h
+	if headFile != nil {
+		b, err := json.Marshal(&h)
+		if err != nil {
+			log.Panicf("Cannot marshal chain head: %v", err)
+		}
+		if _, err := headFile.Write(append(b, '\n')); err != nil {
+			log.Panicf("Cannot write head file %s: %v", headFilePath, err)
+		}
+	}
+	if headCollName != "" {
+		if _, err := db.getHeadCollection(s).UpsertId(h.ShardGroup, &h); err != nil {
+			log.Panicf("Cannot record chain head: %v", err)
+		}
+	}
+}
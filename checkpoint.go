@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"time"
+)
+
+/*
+ * Checkpoints are signed statements of the head of a shard group's chain
+ * and Merkle tree. Unlike the item hashes, which rest on the symmetric hash
+ * secret, a checkpoint can be verified by anyone holding only the public
+ * key (available from GET /checkpoints/publickey).
+ *
+ * The signature is over the following text, with each line terminated by
+ * a single newline (0x0a), integers in decimal and hashes in lower case hex:
+ *
+ *   slogger checkpoint v1
+ *   shard_group <shard group>
+ *   sequence_id <sequence id of the latest item, or -1 if none>
+ *   hash <hash of the latest item, empty if none>
+ *   tree_size <merkle tree size>
+ *   root_hash <merkle root hash>
+ *   timestamp <milliseconds since the unix epoch>
+ *
+ * For Ed25519 keys the signature is a plain Ed25519 signature of this text.
+ * For ECDSA keys it is an ASN.1 DER ECDSA signature of the SHA-256 digest of
+ * this text. Either way it is base64 (standard encoding) in the checkpoint.
+ */
+
+var (
+	signingKeyPath         string
+	checkpointSigner       crypto.Signer
+	checkpointCollName     = "checkpoints"
+	checkpointAlgorithm    string
+	checkpointKeyId        string
+	checkpointPublicKeyPEM []byte
+)
+
+type Checkpoint struct {
+	ShardGroup int       `json:"shard_group"`
+	SequenceId int64     `json:"sequence_id"`
+	Hash       string    `json:"hash"`
+	TreeSize   int64     `json:"tree_size"`
+	RootHash   string    `json:"root_hash"`
+	Time       time.Time `json:"timestamp"`
+	Algorithm  string    `json:"algorithm"`
+	KeyId      string    `json:"key_id"`
+	Signature  string    `json:"signature"`
+}
+
+func (cp *Checkpoint) signedMessage() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "slogger checkpoint v1\n")
+	fmt.Fprintf(&b, "shard_group %d\n", cp.ShardGroup)
+	fmt.Fprintf(&b, "sequence_id %d\n", cp.SequenceId)
+	fmt.Fprintf(&b, "hash %s\n", cp.Hash)
+	fmt.Fprintf(&b, "tree_size %d\n", cp.TreeSize)
+	fmt.Fprintf(&b, "root_hash %s\n", cp.RootHash)
+	fmt.Fprintf(&b, "timestamp %d\n", cp.Time.UnixNano()/int64(time.Millisecond))
+	return b.Bytes()
+}
+
+// The key id is the hex SHA-256 of the DER encoded (PKIX) public key
+func publicKeyId(der []byte) string {
+	sha := sha256.Sum256(der)
+	return hex.EncodeToString(sha[:])
+}
+
+// Load the PEM encoded (PKCS#8 or SEC 1) Ed25519 or ECDSA signing key
+func loadSigningKey() {
+	if signingKeyPath == "" {
+		return
+	}
+	keyPEM, err := ioutil.ReadFile(signingKeyPath)
+	if err != nil {
+		log.Fatal("Cannot read signing key from " + signingKeyPath)
+	}
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		log.Fatal("Cannot decode PEM signing key from " + signingKeyPath)
+	}
+
+	var key interface{}
+	if block.Type == "EC PRIVATE KEY" {
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		log.Fatalf("Cannot parse signing key from %s: %v", signingKeyPath, err)
+	}
+
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		checkpointSigner = k
+		checkpointAlgorithm = "ed25519"
+	case *ecdsa.PrivateKey:
+		checkpointSigner = k
+		checkpointAlgorithm = "ecdsa-sha256"
+	default:
+		log.Fatalf("Signing key in %s must be Ed25519 or ECDSA", signingKeyPath)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(checkpointSigner.Public())
+	if err != nil {
+		log.Fatalf("Cannot marshal public key: %v", err)
+	}
+	checkpointKeyId = publicKeyId(der)
+	checkpointPublicKeyPEM = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	log.Printf("Signing checkpoints with %s key %s\n", checkpointAlgorithm, checkpointKeyId)
+}
+
+func (cp *Checkpoint) sign() {
+	msg := cp.signedMessage()
+	var sig []byte
+	var err error
+	switch checkpointAlgorithm {
+	case "ed25519":
+		sig, err = checkpointSigner.Sign(rand.Reader, msg, crypto.Hash(0))
+	default:
+		digest := sha256.Sum256(msg)
+		sig, err = checkpointSigner.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		log.Panicf("Cannot sign checkpoint: %v", err)
+	}
+	cp.Algorithm = checkpointAlgorithm
+	cp.KeyId = checkpointKeyId
+	cp.Signature = base64.StdEncoding.EncodeToString(sig)
+}
+
+// Verify a checkpoint's signature given only a PEM encoded public key
+func (cp *Checkpoint) verify(publicKeyPEM []byte) error {
+	block, _ := pem.Decode(publicKeyPEM)
+	if block == nil {
+		return errors.New("Cannot decode PEM public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+	if cp.KeyId != publicKeyId(block.Bytes) {
+		return errors.New("Checkpoint was signed by a different key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(cp.Signature)
+	if err != nil {
+		return err
+	}
+	msg := cp.signedMessage()
+	switch k := pub.(type) {
+	case ed25519.PublicKey:
+		if cp.Algorithm == "ed25519" && ed25519.Verify(k, msg, sig) {
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(msg)
+		if cp.Algorithm == "ecdsa-sha256" && ecdsa.VerifyASN1(k, digest[:], sig) {
+			return nil
+		}
+	default:
+		return errors.New("Public key must be Ed25519 or ECDSA")
+	}
+	return errors.New("Bad checkpoint signature")
+}
+
+func latestCheckpoint(db *Database, s *mgo.Session, shardGroup int) (*Checkpoint, bool) {
+	var cp Checkpoint
+	if err := db.getCheckpointCollection(s).Find(bson.M{"shardgroup": shardGroup}).Sort("-time").One(&cp); err != nil {
+		if err != mgo.ErrNotFound {
+			log.Panicf("Query returned error %v\n", err)
+		}
+		return nil, false
+	}
+	return &cp, true
+}
+
+// Sign and store a checkpoint for a tree head, unless we have already done so
+func emitCheckpoint(db *Database, s *mgo.Session, th *TreeHead) {
+	if latest, ok := latestCheckpoint(db, s, th.ShardGroup); ok && latest.TreeSize == th.TreeSize && latest.KeyId == checkpointKeyId {
+		return
+	}
+
+	cp := Checkpoint{
+		ShardGroup: th.ShardGroup,
+		SequenceId: th.TreeSize - 1,
+		TreeSize:   th.TreeSize,
+		RootHash:   th.RootHash,
+		// Mongo stores times to the millisecond, so only sign what we can store
+		Time: time.Now().Truncate(time.Millisecond),
+	}
+	if th.TreeSize > 0 {
+		var item LogItem
+		if err := db.getLogItemCollection(s).Find(bson.M{"shardgroup": th.ShardGroup, "sequenceid": cp.SequenceId}).Select(bson.M{"hash": 1}).One(&item); err != nil {
+			log.Panicf("Query returned error %v\n", err)
+		}
+		cp.Hash = item.Hash
+	}
+	cp.sign()
+	if err := db.getCheckpointCollection(s).Insert(&cp); err != nil {
+		log.Panicf("Could not insert checkpoint %v\n", err)
+	}
+}
+
+// Checkpoints for a shard group (or all shard groups if shardGroup is
+// negative), newest first
+func queryCheckpoints(db *Database, shardGroup int, limit int) []Checkpoint {
+	sessionCopy := db.mongoSession.Copy()
+	defer sessionCopy.Close()
+
+	var query interface{}
+	if shardGroup >= 0 {
+		query = bson.M{"shardgroup": shardGroup}
+	}
+	q := db.getCheckpointCollection(sessionCopy).Find(query).Sort("-time", "shardgroup")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+	checkpoints := []Checkpoint{}
+	if err := q.All(&checkpoints); err != nil {
+		log.Panicf("Query returned error %v\n", err)
+	}
+	return checkpoints
+}
@@ -6,13 +6,15 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"github.com/abligh/cdl"
 	"github.com/abligh/go-syslog"
 	"io/ioutil"
 	"log"
+	"time"
 )
 
-var serviceTypeEnum = cdl.NewEnumType("syslog", "rest")
+var serviceTypeEnum = cdl.NewEnumType("syslog", "rest", "relp", "gelf", "forward")
 var protocolEnum = cdl.NewEnumType("tcp", "udp")
 
 var defaultConfig string = `
@@ -53,15 +55,41 @@ func newService() service {
 
 var services []service
 
+// A configurator for an option taking a positive integer
+func configPositiveInt(dest *int, name string) func(o interface{}, p cdl.Path) *cdl.CdlError {
+	return func(o interface{}, p cdl.Path) *cdl.CdlError {
+		if f, ok := o.(float64); ok && f >= 1 && f == float64(int(f)) {
+			*dest = int(f)
+			return nil
+		}
+		return cdl.NewError("ErrBadOption").SetSupplementary(name + " must be a positive integer")
+	}
+}
+
+// A configurator for an option taking a non-negative integer
+func configNonNegativeInt(dest *int, name string) func(o interface{}, p cdl.Path) *cdl.CdlError {
+	return func(o interface{}, p cdl.Path) *cdl.CdlError {
+		if f, ok := o.(float64); ok && f >= 0 && f == float64(int(f)) {
+			*dest = int(f)
+			return nil
+		}
+		return cdl.NewError("ErrBadOption").SetSupplementary(name + " must be a non-negative integer")
+	}
+}
+
 func readConfig() {
 	template := cdl.Template{
-		"/":            "{}services?{1,} db hashsecret",
+		"/":            "{}services?{1,} db hashsecret? hashsecrets?{1,} shardgroups?{1,} defaultshardgroup? shardindexinterval? ingestlatency? ingestbatchsize? leaseduration? formatversion? merkleinterval? signingkey? headfile? headcollection? headmismatch? scaninterval? scanrate? scanwebhook? hectokens?{1,}",
 		"services":     "{}type listen protocol certpath? keypath? cacertpath?",
 		"type":         serviceTypeEnum,
 		"listen":       "ipport",
 		"protocol":     protocolEnum,
-		"db":           "{}mongoservers{1,} database collection authdatabase? username? password?",
+		"db":           "{}mongoservers{1,} database collection merklecollection? treeheadcollection? checkpointcollection? scancollection? shardindexcollection? leasecollection? pendingcollection? authdatabase? username? password?",
 		"mongoservers": "ipport",
+		"hashsecrets":  "{}id secret active_from?",
+		"shardgroups":  "{}shardgroup account_group_id? client_name? listener? hostname?",
+		"hectokens":    "{}token name?",
+		"headmismatch": headMismatchEnum,
 	}
 
 	if ct, err := cdl.Compile(template); err != nil {
@@ -89,24 +117,123 @@ func readConfig() {
 		}
 
 		var newServ = newService()
+		var newKey hashKey
+		var newRule shardRule
+		var newToken hecToken
 
 		configurator := cdl.Configurator{
 			"mongoserver": func(o interface{}, p cdl.Path) *cdl.CdlError {
 				mongoDBHosts = append(mongoDBHosts, o.(string))
 				return nil
 			},
-			"database":     &databaseName,
-			"collection":   &collectionName,
-			"authdatabase": &authDatabase,
-			"username":     &authUserName,
-			"password":     &authPassword,
+			"database":             &databaseName,
+			"collection":           &collectionName,
+			"merklecollection":     &merkleNodeCollName,
+			"treeheadcollection":   &treeHeadCollName,
+			"checkpointcollection": &checkpointCollName,
+			"scancollection":       &scanStateCollName,
+			"shardindexcollection": &shardIndexCollName,
+			"leasecollection":      &leaseCollName,
+			"pendingcollection":    &pendingCollName,
+			"authdatabase":         &authDatabase,
+			"username":             &authUserName,
+			"password":             &authPassword,
+
+			"hashsecret": func(o interface{}, p cdl.Path) *cdl.CdlError {
+				if err := addHashKey(hashKey{secret: o.(string)}); err != nil {
+					return cdl.NewError("ErrBadOption").SetSupplementary(err.Error())
+				}
+				return nil
+			},
+			"hashsecrets": func(o interface{}, p cdl.Path) *cdl.CdlError {
+				if err := addHashKey(newKey); err != nil {
+					return cdl.NewError("ErrBadOption").SetSupplementary(err.Error())
+				}
+				newKey = hashKey{}
+				return nil
+			},
+			"id":     &newKey.id,
+			"secret": &newKey.secret,
+			"active_from": func(o interface{}, p cdl.Path) *cdl.CdlError {
+				if t, err := time.Parse(time.RFC3339, o.(string)); err != nil {
+					return cdl.NewError("ErrBadOption").SetSupplementary("active_from must be an RFC 3339 time")
+				} else {
+					newKey.activeFrom = t
+				}
+				return nil
+			},
+			"signingkey": &signingKeyPath,
+
+			"headfile":       &headFilePath,
+			"headcollection": &headCollName,
+			"headmismatch":   &headMismatchAction,
 
-			"hashsecret": &hashSecret,
+			"formatversion": func(o interface{}, p cdl.Path) *cdl.CdlError {
+				if f, ok := o.(float64); ok && f >= 1 && f <= maxFormatVersion && f == float64(int(f)) {
+					formatVersion = int(f)
+					return nil
+				}
+				return cdl.NewError("ErrBadOption").SetSupplementary(fmt.Sprintf("formatversion must be an integer from 1 to %d", maxFormatVersion))
+			},
+
+			"shardgroups": func(o interface{}, p cdl.Path) *cdl.CdlError {
+				if newRule.shardGroup < 0 {
+					return cdl.NewError("ErrBadOption").SetSupplementary("shard groups must be non-negative")
+				}
+				shardRules = append(shardRules, newRule)
+				newRule = shardRule{}
+				return nil
+			},
+			"shardgroup":        configNonNegativeInt(&newRule.shardGroup, "shardgroup"),
+			"account_group_id":  &newRule.accountGroupId,
+			"client_name":       &newRule.clientName,
+			"listener":          &newRule.listener,
+			"hostname":          &newRule.hostname,
+			"defaultshardgroup": configNonNegativeInt(&defaultShardGroup, "defaultshardgroup"),
+
+			"shardindexinterval": configNonNegativeInt(&shardIndexInterval, "shardindexinterval"),
+
+			"ingestlatency":   configNonNegativeInt(&ingestLatency, "ingestlatency"),
+			"ingestbatchsize": configPositiveInt(&ingestBatchSize, "ingestbatchsize"),
+
+			"leaseduration": func(o interface{}, p cdl.Path) *cdl.CdlError {
+				if f, ok := o.(float64); ok && f >= 3 && f == float64(int(f)) {
+					leaseDuration = int(f)
+					return nil
+				}
+				return cdl.NewError("ErrBadOption").SetSupplementary("leaseduration must be an integer of at least 3")
+			},
+
+			"merkleinterval": configNonNegativeInt(&merkleInterval, "merkleinterval"),
+
+			"scaninterval": configNonNegativeInt(&scanInterval, "scaninterval"),
+			"scanrate":     configNonNegativeInt(&scanRate, "scanrate"),
+			"scanwebhook":  &scanWebhook,
+
+			"hectokens": func(o interface{}, p cdl.Path) *cdl.CdlError {
+				if newToken.token == "" {
+					return cdl.NewError("ErrBadOption").SetSupplementary("hec tokens must not be empty")
+				}
+				if _, ok := hecTokens[newToken.token]; ok {
+					return cdl.NewError("ErrBadOption").SetSupplementary("hec tokens must be unique")
+				}
+				hecTokens[newToken.token] = newToken.name
+				newToken = hecToken{}
+				return nil
+			},
+			"token": &newToken.token,
+			"name":  &newToken.name,
 
 			"services": func(o interface{}, p cdl.Path) *cdl.CdlError {
 				if newServ.serviceType.String() == "rest" && newServ.protocol.String() != "tcp" {
 					return cdl.NewError("ErrBadOption").SetSupplementary("rest service can only run over tcp")
 				}
+				if newServ.serviceType.String() == "relp" && newServ.protocol.String() != "tcp" {
+					return cdl.NewError("ErrBadOption").SetSupplementary("relp service can only run over tcp")
+				}
+				if newServ.serviceType.String() == "forward" && newServ.protocol.String() != "tcp" {
+					return cdl.NewError("ErrBadOption").SetSupplementary("forward service can only run over tcp")
+				}
 				if newServ.certpath != "" || newServ.keypath != "" || newServ.cacertpath != "" {
 					if newServ.protocol.String() != "tcp" {
 						return cdl.NewError("ErrBadOption").SetSupplementary("tls can only run over tcp")
@@ -131,6 +258,13 @@ func readConfig() {
 			log.Fatalf("Error reading configuration: %s", err)
 		}
 
+		if len(hashKeys) == 0 {
+			log.Fatal("Configuration must give a hashsecret or hashsecrets")
+		}
+		if _, ok := activeHashKey(time.Now()); !ok {
+			log.Fatal("No hash secret is active yet")
+		}
+
 		if len(mongoDBHosts) == 0 {
 			mongoDBHosts = []string{"127.0.0.1:27017"}
 		}
@@ -177,11 +311,12 @@ func getServiceConfig(s service) *tls.Config {
 
 func startServices(db *Database) {
 
-	server := syslog.NewServer()
-
 	for _, s := range services {
 		switch s.serviceType.String() {
 		case "syslog":
+			// Each syslog service has its own server so we know which
+			// listener received each message
+			server := syslog.NewServer()
 			switch s.protocol.String() {
 			case "udp":
 				log.Printf("Starting syslog UDP on %s\n", s.listen)
@@ -195,6 +330,7 @@ func startServices(db *Database) {
 					server.ListenTCP(s.listen)
 				}
 			}
+			go syslogServerRun(server, db, s.listen)
 		case "rest":
 			if s.certpath != "" {
 				log.Printf("Starting https on %s\n", s.listen)
@@ -203,8 +339,37 @@ func startServices(db *Database) {
 				log.Printf("Starting http on %s\n", s.listen)
 				go httpServerStart(db, s.listen)
 			}
+		case "relp":
+			if s.certpath != "" {
+				log.Printf("Starting RELP+TLS on %s\n", s.listen)
+				go relpServerStart(db, s.listen, getServiceConfig(s))
+			} else {
+				log.Printf("Starting RELP on %s\n", s.listen)
+				go relpServerStart(db, s.listen, nil)
+			}
+		case "gelf":
+			switch {
+			case s.protocol.String() == "udp":
+				log.Printf("Starting GELF UDP on %s\n", s.listen)
+				go gelfUDPServerStart(db, s.listen)
+			case s.certpath != "":
+				log.Printf("Starting GELF TCP+TLS on %s\n", s.listen)
+				go gelfTCPServerStart(db, s.listen, getServiceConfig(s))
+			default:
+				log.Printf("Starting GELF TCP on %s\n", s.listen)
+				go gelfTCPServerStart(db, s.listen, nil)
+			}
+		case "forward":
+			if s.certpath != "" {
+				log.Printf("Starting Forward+TLS on %s\n", s.listen)
+				go forwardServerStart(db, s.listen, getServiceConfig(s))
+			} else {
+				log.Printf("Starting Forward on %s\n", s.listen)
+				go forwardServerStart(db, s.listen, nil)
+			}
 		}
 	}
 
-	syslogServerRun(server, db)
+	// Every service runs in its own goroutine
+	select {}
 }
@@ -69,6 +69,28 @@ func (db *Database) getLogItemCollection(s *mgo.Session) *mgo.Collection {
 	return s.DB(databaseName).C(collectionName)
 }
 
+func (db *Database) getMerkleNodeCollection(s *mgo.Session) *mgo.Collection {
+	return s.DB(databaseName).C(merkleNodeCollName)
+}
+
+func (db *Database) getTreeHeadCollection(s *mgo.Session) *mgo.Collection {
+	return s.DB(databaseName).C(treeHeadCollName)
+}
+
+func (db *Database) getCheckpointCollection(s *mgo.Session) *mgo.Collection {
+	return s.DB(databaseName).C(checkpointCollName)
+}
+
+// The shard groups which have at least one log item
+func (db *Database) shardGroups(s *mgo.Session) []int {
+	var sgs []int
+	if err := db.getLogItemCollection(s).Find(nil).Distinct("shardgroup", &sgs); err != nil {
+		log.Panicf("Query returned error %v\n", err)
+	}
+	sort.Ints(sgs)
+	return sgs
+}
+
 func (db *Database) ensureIndices() {
 	// We want to ensure that every field in mongo is indexed.
 	keys := structs.Names(&LogItem{})
@@ -98,6 +120,53 @@ func (db *Database) ensureIndices() {
 			panic("Could not add index")
 		}
 	}
+
+	// Structured data is indexed by element id and param
+	for _, k := range [][]string{{"structureddata.id"}, {"structureddata.params.name", "structureddata.params.value"}} {
+		if err := c.EnsureIndex(mgo.Index{Key: k}); err != nil {
+			panic("Could not add structured data index")
+		}
+	}
+
+	if err := db.getMerkleNodeCollection(sessionCopy).EnsureIndex(mgo.Index{
+		Key:    []string{"shardgroup", "level", "index"},
+		Unique: true,
+	}); err != nil {
+		panic("Could not add merkle node index")
+	}
+	if err := db.getTreeHeadCollection(sessionCopy).EnsureIndex(mgo.Index{
+		Key:    []string{"shardgroup", "treesize"},
+		Unique: true,
+	}); err != nil {
+		panic("Could not add tree head index")
+	}
+	if err := db.getCheckpointCollection(sessionCopy).EnsureIndex(mgo.Index{
+		Key: []string{"shardgroup", "time"},
+	}); err != nil {
+		panic("Could not add checkpoint index")
+	}
+	if err := db.getShardIndexCollection(sessionCopy).EnsureIndex(mgo.Index{
+		Key:    []string{"window"},
+		Unique: true,
+	}); err != nil {
+		panic("Could not add shard index index")
+	}
+	if err := db.getPendingCollection(sessionCopy).EnsureIndex(mgo.Index{
+		Key: []string{"shardgroup", "_id"},
+	}); err != nil {
+		panic("Could not add pending index")
+	}
+	if err := db.getPendingCollection(sessionCopy).EnsureIndex(mgo.Index{
+		Key:         []string{"chainedat"},
+		ExpireAfter: pendingExpiry,
+	}); err != nil {
+		panic("Could not add pending expiry index")
+	}
+	if err := db.getShardIndexCollection(sessionCopy).EnsureIndex(mgo.Index{
+		Key: []string{"end"},
+	}); err != nil {
+		panic("Could not add shard index index")
+	}
 }
 
 func buildJsonMap() {
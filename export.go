@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"os"
+	"time"
+)
+
+/*
+ * Export files hold a range of a shard group's chain, together with the
+ * tree heads and checkpoints covering it, so that it can be verified
+ * without access to the database (see 'slogger verify-file').
+ *
+ * An export file is a sequence of records, each a JSON object with a 'type'
+ * and an object named after that type. The first record is a header, then
+ * come the tree heads, then the checkpoints, and finally the log items in
+ * sequence id order:
+ *
+ *   {"type":"header","header":{...}}
+ *   {"type":"treehead","treehead":{...}}
+ *   {"type":"checkpoint","checkpoint":{...}}
+ *   {"type":"logitem","logitem":{...}}
+ *
+ * In 'ndjson' format each record is on its own line. In 'lengthdelimited'
+ * format each record is preceded by its length in bytes as a big endian u32.
+ */
+
+const exportFormatName = "slogger-export-v1"
+
+type exportHeader struct {
+	Format     string    `json:"format"`
+	ShardGroup int       `json:"shard_group"`
+	From       int64     `json:"from"`
+	To         int64     `json:"to"`
+	Exported   time.Time `json:"exported"`
+}
+
+type exportRecord struct {
+	Type       string        `json:"type"`
+	Header     *exportHeader `json:"header,omitempty"`
+	TreeHead   *TreeHead     `json:"treehead,omitempty"`
+	Checkpoint *Checkpoint   `json:"checkpoint,omitempty"`
+	LogItem    *LogItem      `json:"logitem,omitempty"`
+}
+
+type exportWriter struct {
+	w               *bufio.Writer
+	lengthDelimited bool
+}
+
+func (e *exportWriter) write(r *exportRecord) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		log.Panicf("Cannot marshal export record: %v", err)
+	}
+	if e.lengthDelimited {
+		var l [4]byte
+		binary.BigEndian.PutUint32(l[:], uint32(len(b)))
+		e.w.Write(l[:])
+		e.w.Write(b)
+	} else {
+		e.w.Write(b)
+		e.w.WriteByte('\n')
+	}
+}
+
+type exportReader struct {
+	r               *bufio.Reader
+	lengthDelimited bool
+	bounded         bool  // Whether we know the size of the file
+	remaining       int64 // Bytes left in the file, if bounded
+}
+
+var errExportRecordTooLong = errors.New("Export record is longer than the rest of the file")
+
+func (e *exportReader) read() (*exportRecord, error) {
+	var b []byte
+	var err error
+	if e.lengthDelimited {
+		var l [4]byte
+		if _, err = io.ReadFull(e.r, l[:]); err != nil {
+			return nil, err
+		}
+		n := int64(binary.BigEndian.Uint32(l[:]))
+		if e.bounded {
+			if e.remaining -= 4; n > e.remaining {
+				return nil, errExportRecordTooLong
+			}
+			e.remaining -= n
+		}
+		// The length may not be honest, so let the buffer grow only as
+		// data arrives
+		var buf bytes.Buffer
+		if _, err = io.CopyN(&buf, e.r, n); err != nil {
+			if err == io.EOF {
+				err = errExportRecordTooLong
+			}
+			return nil, err
+		}
+		b = buf.Bytes()
+	} else {
+		for len(bytes.TrimSpace(b)) == 0 {
+			if b, err = e.r.ReadBytes('\n'); err != nil && (err != io.EOF || len(b) == 0) {
+				return nil, err
+			}
+		}
+	}
+	var r exportRecord
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func isLengthDelimited(format string) bool {
+	switch format {
+	case "ndjson":
+		return false
+	case "lengthdelimited":
+		return true
+	}
+	log.Fatalf("Unknown format %s: must be ndjson or lengthdelimited", format)
+	return false
+}
+
+func exportChain(db *Database, w *exportWriter, shardGroup int, from int64, to int64) int {
+	sessionCopy := db.mongoSession.Copy()
+	defer sessionCopy.Close()
+
+	w.write(&exportRecord{Type: "header", Header: &exportHeader{
+		Format:     exportFormatName,
+		ShardGroup: shardGroup,
+		From:       from,
+		To:         to,
+		Exported:   time.Now(),
+	}})
+
+	// Tree heads and checkpoints are only of use if they do not go beyond
+	// the exported range
+	sizeQuery := bson.M{"$gt": from}
+	if to >= 0 {
+		sizeQuery["$lte"] = to + 1
+	}
+	var th TreeHead
+	iter := db.getTreeHeadCollection(sessionCopy).Find(bson.M{"shardgroup": shardGroup, "treesize": sizeQuery}).Sort("treesize").Iter()
+	for iter.Next(&th) {
+		t := th
+		w.write(&exportRecord{Type: "treehead", TreeHead: &t})
+	}
+	if err := iter.Close(); err != nil {
+		log.Panicf("Error while iterating: %v\n", err)
+	}
+	var cp Checkpoint
+	iter = db.getCheckpointCollection(sessionCopy).Find(bson.M{"shardgroup": shardGroup, "treesize": sizeQuery}).Sort("time").Iter()
+	for iter.Next(&cp) {
+		t := cp
+		w.write(&exportRecord{Type: "checkpoint", Checkpoint: &t})
+	}
+	if err := iter.Close(); err != nil {
+		log.Panicf("Error while iterating: %v\n", err)
+	}
+
+	seqQuery := bson.M{"$gte": from}
+	if to >= 0 {
+		seqQuery["$lte"] = to
+	}
+	items := 0
+	var l LogItem
+	iter = db.getLogItemCollection(sessionCopy).Find(bson.M{"shardgroup": shardGroup, "sequenceid": seqQuery}).Sort("sequenceid", "_id").Iter()
+	for iter.Next(&l) {
+		t := l
+		w.write(&exportRecord{Type: "logitem", LogItem: &t})
+		items++
+	}
+	if err := iter.Close(); err != nil {
+		log.Panicf("Error while iterating: %v\n", err)
+	}
+	return items
+}
+
+func exportMain() {
+	shardGroup := flag.Int("shardgroup", -1, "shard group to export")
+	from := flag.Int64("from", 0, "first sequence id to export")
+	to := flag.Int64("to", -1, "last sequence id to export (default the end of the chain)")
+	out := flag.String("out", "", "path to output file (default stdout)")
+	format := flag.String("format", "ndjson", "output format: ndjson or lengthdelimited")
+	readConfig()
+	buildJsonMap()
+	initFieldProperties()
+
+	if *shardGroup < 0 {
+		log.Fatal("export needs a -shardgroup")
+	}
+	w := &exportWriter{lengthDelimited: isLengthDelimited(*format)}
+	f := os.Stdout
+	if *out != "" {
+		var err error
+		if f, err = os.Create(*out); err != nil {
+			log.Fatalf("Cannot create %s: %v", *out, err)
+		}
+	}
+	w.w = bufio.NewWriter(f)
+
+	db := newDatabase()
+	items := exportChain(db, w, *shardGroup, *from, *to)
+	if err := w.w.Flush(); err != nil {
+		log.Fatalf("Cannot write export: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatalf("Cannot write export: %v", err)
+	}
+	log.Printf("Exported %d items from shard group %d\n", items, *shardGroup)
+}
+
+type fileReport struct {
+	Chain              *chainReport `json:"chain"`
+	TreeHeadsChecked   int          `json:"tree_heads_checked"`
+	TreeHeadsFailed    []int64      `json:"tree_heads_failed"`
+	CheckpointsChecked int          `json:"checkpoints_checked"`
+	CheckpointsFailed  []int64      `json:"checkpoints_failed"`
+	// Tree heads and checkpoints whose roots could not be recomputed
+	Unchecked int `json:"unchecked"`
+	// Checkpoints whose signatures were not verified, for want of a key
+	SignaturesUnverified int  `json:"signatures_unverified"`
+	Ok                   bool `json:"ok"`
+}
+
+// fileVerifier checks an export file. Merkle roots (of tree heads and
+// checkpoints) can only be recomputed if the export starts at sequence id 0,
+// so a file with any which cannot be is not reported ok.
+type fileVerifier struct {
+	header      *exportHeader
+	chain       *chainVerifier
+	frontier    merkleFrontier
+	publicKey   []byte
+	treeHeads   map[int64][]TreeHead
+	checkpoints map[int64][]Checkpoint
+	hashes      map[int64]string // hashes of items at the sequence ids of checkpoints
+	report      fileReport
+}
+
+func newFileVerifier(publicKey []byte) *fileVerifier {
+	return &fileVerifier{
+		publicKey:   publicKey,
+		treeHeads:   make(map[int64][]TreeHead),
+		checkpoints: make(map[int64][]Checkpoint),
+		hashes:      make(map[int64]string),
+		report: fileReport{
+			TreeHeadsFailed:   []int64{},
+			CheckpointsFailed: []int64{},
+		},
+	}
+}
+
+func (v *fileVerifier) add(r *exportRecord) error {
+	if v.header == nil && r.Type != "header" {
+		return errors.New("Export file does not start with a header")
+	}
+	switch r.Type {
+	case "header":
+		if v.header != nil || r.Header == nil {
+			return errors.New("Bad header record")
+		}
+		if r.Header.Format != exportFormatName {
+			return fmt.Errorf("Unknown export format %s", r.Header.Format)
+		}
+		v.header = r.Header
+		v.chain = newChainVerifier(r.Header.ShardGroup, r.Header.From, r.Header.To)
+	case "treehead":
+		if r.TreeHead == nil || r.TreeHead.ShardGroup != v.header.ShardGroup {
+			return errors.New("Bad treehead record")
+		}
+		v.treeHeads[r.TreeHead.TreeSize] = append(v.treeHeads[r.TreeHead.TreeSize], *r.TreeHead)
+	case "checkpoint":
+		if r.Checkpoint == nil || r.Checkpoint.ShardGroup != v.header.ShardGroup {
+			return errors.New("Bad checkpoint record")
+		}
+		if v.publicKey == nil {
+			v.report.SignaturesUnverified++
+		} else if err := r.Checkpoint.verify(v.publicKey); err != nil {
+			log.Printf("Checkpoint at tree size %d: %v\n", r.Checkpoint.TreeSize, err)
+			v.report.CheckpointsFailed = append(v.report.CheckpointsFailed, r.Checkpoint.TreeSize)
+			return nil
+		}
+		v.checkpoints[r.Checkpoint.TreeSize] = append(v.checkpoints[r.Checkpoint.TreeSize], *r.Checkpoint)
+	case "logitem":
+		if r.LogItem == nil || r.LogItem.ShardGroup != v.header.ShardGroup {
+			return errors.New("Bad logitem record")
+		}
+		v.chain.add(r.LogItem)
+		v.hashes[r.LogItem.SequenceId] = r.LogItem.Hash
+		if v.header.From == 0 && r.LogItem.SequenceId == v.frontier.size {
+			v.frontier.append(nil, r.LogItem.merkleLeaf())
+			v.checkRoots()
+		}
+	default:
+		return fmt.Errorf("Unknown record type %s", r.Type)
+	}
+	return nil
+}
+
+// Check any tree heads and checkpoints at the current tree size
+func (v *fileVerifier) checkRoots() {
+	size := v.frontier.size
+	root := hex.EncodeToString(v.frontier.root())
+	for _, th := range v.treeHeads[size] {
+		v.report.TreeHeadsChecked++
+		if th.RootHash != root {
+			v.report.TreeHeadsFailed = append(v.report.TreeHeadsFailed, size)
+		}
+	}
+	delete(v.treeHeads, size)
+	for _, cp := range v.checkpoints[size] {
+		v.report.CheckpointsChecked++
+		if cp.RootHash != root || cp.Hash != v.hashes[cp.SequenceId] || cp.SequenceId != size-1 {
+			v.report.CheckpointsFailed = append(v.report.CheckpointsFailed, size)
+		}
+	}
+	delete(v.checkpoints, size)
+}
+
+func (v *fileVerifier) finish() *fileReport {
+	if v.header == nil {
+		return nil
+	}
+	for _, ths := range v.treeHeads {
+		v.report.Unchecked += len(ths)
+	}
+	for _, cps := range v.checkpoints {
+		v.report.Unchecked += len(cps)
+	}
+	v.report.Chain = v.chain.finish()
+	v.report.Ok = v.report.Chain.Intact && len(v.report.TreeHeadsFailed) == 0 && len(v.report.CheckpointsFailed) == 0 &&
+		v.report.SignaturesUnverified == 0 && v.report.Unchecked == 0
+	return &v.report
+}
+
+func verifyFileMain() {
+	in := flag.String("in", "", "path to export file (default stdin)")
+	format := flag.String("format", "ndjson", "input format: ndjson or lengthdelimited")
+	publicKeyPath := flag.String("publickey", "", "path to PEM public key with which to verify checkpoint signatures (required for a file with checkpoints to verify)")
+	readConfig()
+	buildJsonMap()
+	initFieldProperties()
+
+	var publicKey []byte
+	if *publicKeyPath != "" {
+		var err error
+		if publicKey, err = ioutil.ReadFile(*publicKeyPath); err != nil {
+			log.Fatal("Cannot read public key from " + *publicKeyPath)
+		}
+	}
+
+	f := os.Stdin
+	if *in != "" {
+		var err error
+		if f, err = os.Open(*in); err != nil {
+			log.Fatalf("Cannot open %s: %v", *in, err)
+		}
+		defer f.Close()
+	}
+	r := &exportReader{r: bufio.NewReader(f), lengthDelimited: isLengthDelimited(*format)}
+	if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+		r.bounded = true
+		r.remaining = info.Size()
+	}
+
+	v := newFileVerifier(publicKey)
+	for {
+		record, err := r.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatalf("Cannot read export file: %v", err)
+		}
+		if err := v.add(record); err != nil {
+			log.Fatalf("Bad export file: %v", err)
+		}
+	}
+
+	report := v.finish()
+	if report == nil {
+		log.Fatal("Export file is empty")
+	}
+	if err := json.NewEncoder(os.Stdout).Encode(report); err != nil {
+		log.Fatalf("Cannot write report: %v", err)
+	}
+	if report.Unchecked > 0 {
+		log.Printf("%d tree heads and checkpoints were not verified: their roots can only be recomputed from an export starting at sequence id 0\n", report.Unchecked)
+	}
+	if !report.Ok {
+		os.Exit(1)
+	}
+}
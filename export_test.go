@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const exportTestItems = 5
+
+// An export of a chain of exportTestItems items, with a tree head at every
+// size and a checkpoint at the last signed by a fresh key, whose PEM public
+// key is returned too
+func exportTestRecords(t *testing.T) ([]*exportRecord, []byte) {
+	setupHashTest(t)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedSigner, savedAlgorithm, savedKeyId := checkpointSigner, checkpointAlgorithm, checkpointKeyId
+	checkpointSigner, checkpointAlgorithm, checkpointKeyId = priv, "ed25519", publicKeyId(der)
+	t.Cleanup(func() {
+		checkpointSigner, checkpointAlgorithm, checkpointKeyId = savedSigner, savedAlgorithm, savedKeyId
+	})
+
+	records := []*exportRecord{{Type: "header", Header: &exportHeader{Format: exportFormatName, ShardGroup: 1, To: -1}}}
+	var items []*exportRecord
+	var f merkleFrontier
+	previous := ""
+	for i := 0; i < exportTestItems; i++ {
+		l := &LogItem{
+			Message:       fmt.Sprintf("item %d", i),
+			Level:         "info",
+			ShardGroup:    1,
+			SequenceId:    int64(i),
+			PreviousHash:  previous,
+			FormatVersion: 3,
+			KeyId:         "k1",
+		}
+		if err := l.makeHash(); err != nil {
+			t.Fatal(err)
+		}
+		previous = l.Hash
+		f.append(nil, l.merkleLeaf())
+		records = append(records, &exportRecord{Type: "treehead", TreeHead: &TreeHead{ShardGroup: 1, TreeSize: f.size, RootHash: hex.EncodeToString(f.root())}})
+		items = append(items, &exportRecord{Type: "logitem", LogItem: l})
+	}
+	cp := &Checkpoint{
+		ShardGroup: 1,
+		SequenceId: exportTestItems - 1,
+		Hash:       previous,
+		TreeSize:   exportTestItems,
+		RootHash:   hex.EncodeToString(f.root()),
+		Time:       time.Unix(1700000000, 0),
+	}
+	cp.sign()
+	records = append(records, &exportRecord{Type: "checkpoint", Checkpoint: cp})
+	return append(records, items...), pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// The records as exported from a sequence id on: only the items from
+// there, and the tree heads and checkpoints beyond it
+func exportTestFrom(records []*exportRecord, from int64) []*exportRecord {
+	records[0].Header.From = from
+	var out []*exportRecord
+	for _, r := range records {
+		switch {
+		case r.TreeHead != nil && r.TreeHead.TreeSize <= from:
+		case r.Checkpoint != nil && r.Checkpoint.TreeSize <= from:
+		case r.LogItem != nil && r.LogItem.SequenceId < from:
+		default:
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func exportTestVerify(t *testing.T, records []*exportRecord, publicKey []byte) *fileReport {
+	v := newFileVerifier(publicKey)
+	for _, r := range records {
+		if err := v.add(r); err != nil {
+			t.Fatalf("add returned %v", err)
+		}
+	}
+	return v.finish()
+}
+
+func TestFileVerifier(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		modify func(records []*exportRecord, publicKey []byte) ([]*exportRecord, []byte)
+		ok     bool
+		check  func(r *fileReport) bool
+	}{
+		{"intact", func(records []*exportRecord, publicKey []byte) ([]*exportRecord, []byte) {
+			return records, publicKey
+		}, true, func(r *fileReport) bool {
+			return r.TreeHeadsChecked == exportTestItems && r.CheckpointsChecked == 1 && r.Chain.Count == exportTestItems
+		}},
+		{"tampered item", func(records []*exportRecord, publicKey []byte) ([]*exportRecord, []byte) {
+			records[len(records)-2].LogItem.Message = "changed"
+			return records, publicKey
+		}, false, func(r *fileReport) bool {
+			return reflect.DeepEqual(r.Chain.BadHashes, []int64{exportTestItems - 2})
+		}},
+		{"tampered tree head", func(records []*exportRecord, publicKey []byte) ([]*exportRecord, []byte) {
+			records[3].TreeHead.RootHash = records[2].TreeHead.RootHash
+			return records, publicKey
+		}, false, func(r *fileReport) bool {
+			return reflect.DeepEqual(r.TreeHeadsFailed, []int64{3}) && len(r.CheckpointsFailed) == 0
+		}},
+		{"bad checkpoint signature", func(records []*exportRecord, publicKey []byte) ([]*exportRecord, []byte) {
+			cp := records[exportTestItems+1].Checkpoint
+			sig, _ := base64.StdEncoding.DecodeString(cp.Signature)
+			sig[0] ^= 1
+			cp.Signature = base64.StdEncoding.EncodeToString(sig)
+			return records, publicKey
+		}, false, func(r *fileReport) bool {
+			return reflect.DeepEqual(r.CheckpointsFailed, []int64{exportTestItems})
+		}},
+		{"checkpoint with a changed root", func(records []*exportRecord, publicKey []byte) ([]*exportRecord, []byte) {
+			cp := records[exportTestItems+1].Checkpoint
+			cp.RootHash = records[1].TreeHead.RootHash
+			cp.sign()
+			return records, publicKey
+		}, false, func(r *fileReport) bool {
+			return reflect.DeepEqual(r.CheckpointsFailed, []int64{exportTestItems})
+		}},
+		{"checkpoint signed by another key", func(records []*exportRecord, publicKey []byte) ([]*exportRecord, []byte) {
+			pub, _, _ := ed25519.GenerateKey(rand.Reader)
+			der, _ := x509.MarshalPKIXPublicKey(pub)
+			return records, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		}, false, func(r *fileReport) bool {
+			return reflect.DeepEqual(r.CheckpointsFailed, []int64{exportTestItems})
+		}},
+		{"no public key", func(records []*exportRecord, publicKey []byte) ([]*exportRecord, []byte) {
+			return records, nil
+		}, false, func(r *fileReport) bool {
+			return r.SignaturesUnverified == 1 && r.CheckpointsChecked == 1 && len(r.CheckpointsFailed) == 0
+		}},
+		{"from after the start", func(records []*exportRecord, publicKey []byte) ([]*exportRecord, []byte) {
+			return exportTestFrom(records, 2), publicKey
+		}, false, func(r *fileReport) bool {
+			return r.Chain.Intact && r.TreeHeadsChecked == 0 && r.CheckpointsChecked == 0 && r.Unchecked == exportTestItems-2+1
+		}},
+		{"from after the start without tree heads or checkpoints", func(records []*exportRecord, publicKey []byte) ([]*exportRecord, []byte) {
+			var items []*exportRecord
+			for _, r := range exportTestFrom(records, 2) {
+				if r.TreeHead == nil && r.Checkpoint == nil {
+					items = append(items, r)
+				}
+			}
+			return items, publicKey
+		}, true, func(r *fileReport) bool {
+			return r.Chain.Count == exportTestItems-2 && r.Unchecked == 0
+		}},
+		{"missing item", func(records []*exportRecord, publicKey []byte) ([]*exportRecord, []byte) {
+			return append(records[:len(records)-3], records[len(records)-2:]...), publicKey
+		}, false, func(r *fileReport) bool {
+			return len(r.Chain.Gaps) == 1 && r.Unchecked > 0
+		}},
+	} {
+		records, publicKey := tc.modify(exportTestRecords(t))
+		r := exportTestVerify(t, records, publicKey)
+		if r.Ok != tc.ok || !tc.check(r) {
+			t.Errorf("%s: got %+v with chain %+v", tc.name, r, r.Chain)
+		}
+	}
+}
+
+func TestFileVerifierBadRecords(t *testing.T) {
+	records, _ := exportTestRecords(t)
+	header := records[0]
+	for _, tc := range []struct {
+		name    string
+		records []*exportRecord
+	}{
+		{"no header", records[1:]},
+		{"two headers", []*exportRecord{header, header}},
+		{"unknown format", []*exportRecord{{Type: "header", Header: &exportHeader{Format: "x"}}}},
+		{"other shard group", []*exportRecord{header, {Type: "treehead", TreeHead: &TreeHead{ShardGroup: 2}}}},
+		{"missing item", []*exportRecord{header, {Type: "logitem"}}},
+		{"unknown type", []*exportRecord{header, {Type: "x"}}},
+	} {
+		v := newFileVerifier(nil)
+		var err error
+		for _, r := range tc.records {
+			if err = v.add(r); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			t.Errorf("%s: accepted", tc.name)
+		}
+	}
+	if newFileVerifier(nil).finish() != nil {
+		t.Error("empty file reported")
+	}
+}
+
+// Records are read back as written, in either format
+func TestExportReadWrite(t *testing.T) {
+	records, publicKey := exportTestRecords(t)
+	for _, lengthDelimited := range []bool{false, true} {
+		var buf bytes.Buffer
+		w := &exportWriter{w: bufio.NewWriter(&buf), lengthDelimited: lengthDelimited}
+		for _, r := range records {
+			w.write(r)
+		}
+		w.w.Flush()
+		size := int64(buf.Len())
+		r := &exportReader{r: bufio.NewReader(&buf), lengthDelimited: lengthDelimited, bounded: true, remaining: size}
+		v := newFileVerifier(publicKey)
+		for {
+			record, err := r.read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("length delimited %v: %v", lengthDelimited, err)
+			}
+			if err := v.add(record); err != nil {
+				t.Fatalf("length delimited %v: %v", lengthDelimited, err)
+			}
+		}
+		if report := v.finish(); !report.Ok {
+			t.Errorf("length delimited %v: got %+v", lengthDelimited, report)
+		}
+	}
+}
+
+func TestExportReadLengthDelimited(t *testing.T) {
+	record := []byte(`{"type":"x"}`)
+	for _, tc := range []struct {
+		name    string
+		length  uint32
+		bounded bool
+		err     error
+	}{
+		{"exact", uint32(len(record)), true, nil},
+		{"longer than the file", uint32(len(record)) + 1, true, errExportRecordTooLong},
+		{"huge", 0xffffffff, true, errExportRecordTooLong},
+		{"longer than the data", uint32(len(record)) + 1, false, errExportRecordTooLong},
+	} {
+		in := make([]byte, 4, 4+len(record))
+		binary.BigEndian.PutUint32(in, tc.length)
+		in = append(in, record...)
+		r := &exportReader{r: bufio.NewReader(bytes.NewReader(in)), lengthDelimited: true, bounded: tc.bounded, remaining: int64(len(in))}
+		if _, err := r.read(); err != tc.err {
+			t.Errorf("%s: error %v, want %v", tc.name, err, tc.err)
+		}
+	}
+	r := &exportReader{r: bufio.NewReader(bytes.NewReader([]byte{0, 0})), lengthDelimited: true}
+	if _, err := r.read(); err != io.ErrUnexpectedEOF {
+		t.Errorf("truncated length: error %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"time"
+)
+
+/*
+ * The Fluentd Forward protocol (v1), as sent by Fluentd's out_forward and
+ * Fluent Bit's forward output. Each message on the connection is a
+ * msgpack array in one of these modes:
+ *
+ *   Message:                 [tag, time, record, option?]
+ *   Forward:                 [tag, [[time, record], ...], option?]
+ *   PackedForward:           [tag, bin, option?], bin holding a stream of
+ *                            msgpack [time, record] entries
+ *   CompressedPackedForward: as PackedForward, with the entries gzipped and
+ *                            option {"compressed": "gzip"}
+ *
+ * A time is integer seconds or an EventTime (ext type 0 holding seconds and
+ * nanoseconds as two big endian u32s). If the option has a 'chunk' we reply
+ * {"ack": chunk} once every entry in the message has been committed to the
+ * chain. We do not support the shared key handshake; use TLS client
+ * certificates to authenticate senders.
+ *
+ * The tag becomes app_name. Record keys map onto LogItem fields as follows,
+ * and any others are kept as attributes:
+ *
+ *   log or message -> message, level or severity -> level,
+ *   host or hostname -> hostname, pid -> pid, user -> user,
+ *   instance_id -> instance_id, account_group_id -> account_group_id
+ */
+
+const forwardMaxUncompressed = 64 * 1024 * 1024
+
+type forwardEntry struct {
+	time   interface{}
+	record interface{}
+}
+
+func forwardTime(v interface{}) (time.Time, bool) {
+	switch t := v.(type) {
+	case int64:
+		return time.Unix(t, 0), true
+	case uint64:
+		return time.Unix(int64(t), 0), true
+	case float64:
+		return time.Unix(0, int64(t*1e9)), true
+	case msgpackExt:
+		if t.Type == 0 && len(t.Data) == 8 {
+			return time.Unix(int64(binary.BigEndian.Uint32(t.Data[0:4])), int64(binary.BigEndian.Uint32(t.Data[4:8]))), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func forwardString(v interface{}) string {
+	if b, ok := v.([]byte); ok {
+		return string(b)
+	}
+	return attributeString(v)
+}
+
+// Make a log item from a record
+func forwardLogItem(tag string, t interface{}, record interface{}) (*LogItem, error) {
+	m, ok := record.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Forward record is not a map")
+	}
+	l := &LogItem{AppName: tag}
+	if ot, ok := forwardTime(t); ok {
+		l.OriginatorTime = ot
+	}
+	for k, v := range m {
+		switch k {
+		case "log", "message":
+			l.Message = forwardString(v)
+		case "level", "severity":
+			l.Level = forwardString(v)
+		case "host", "hostname":
+			l.Hostname = forwardString(v)
+		case "pid":
+			if pid, err := strconv.Atoi(forwardString(v)); err == nil {
+				l.Pid = pid
+			}
+		case "user":
+			l.User = forwardString(v)
+		case "instance_id":
+			l.InstanceId = forwardString(v)
+		case "account_group_id":
+			l.AccountGroupId = forwardString(v)
+		default:
+			if b, ok := v.([]byte); ok {
+				v = string(b)
+			}
+			l.setAttribute(k, attributeString(v))
+		}
+	}
+	return l, nil
+}
+
+// Decode the entries of a PackedForward or CompressedPackedForward message
+func forwardPackedEntries(b []byte, compressed bool) ([]forwardEntry, error) {
+	var r io.Reader = bytes.NewReader(b)
+	if compressed {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		// Decompress in full, so a bad stream fails before anything is chained
+		data, err := ioutil.ReadAll(io.LimitReader(gz, forwardMaxUncompressed+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > forwardMaxUncompressed {
+			return nil, errors.New("Forward entries too long")
+		}
+		r = bytes.NewReader(data)
+	}
+	d := newMsgpackDecoder(r)
+	var entries []forwardEntry
+	for {
+		v, err := d.decode()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		e, ok := v.([]interface{})
+		if !ok || len(e) != 2 {
+			return nil, errors.New("bad Forward entry")
+		}
+		entries = append(entries, forwardEntry{e[0], e[1]})
+	}
+}
+
+// Decode a Forward protocol message into its tag, entries and option
+func forwardMessage(v interface{}) (string, []forwardEntry, map[string]interface{}, error) {
+	a, ok := v.([]interface{})
+	if !ok || len(a) < 2 {
+		return "", nil, nil, errors.New("Forward message is not an array")
+	}
+	tag, ok := a[0].(string)
+	if !ok {
+		return "", nil, nil, errors.New("Forward tag is not a string")
+	}
+
+	var entries []forwardEntry
+	var option map[string]interface{}
+	getOption := func(i int) {
+		if len(a) > i {
+			option, _ = a[i].(map[string]interface{})
+		}
+	}
+	switch t := a[1].(type) {
+	case []interface{}:
+		// Forward
+		for _, e := range t {
+			pair, ok := e.([]interface{})
+			if !ok || len(pair) != 2 {
+				return "", nil, nil, errors.New("bad Forward entry")
+			}
+			entries = append(entries, forwardEntry{pair[0], pair[1]})
+		}
+		getOption(2)
+	case []byte, string:
+		// PackedForward or CompressedPackedForward
+		getOption(2)
+		compressed := option != nil && forwardString(option["compressed"]) == "gzip"
+		var err error
+		if entries, err = forwardPackedEntries([]byte(forwardString(t)), compressed); err != nil {
+			return "", nil, nil, err
+		}
+	default:
+		// Message
+		if len(a) < 3 {
+			return "", nil, nil, errors.New("Forward message has no record")
+		}
+		entries = []forwardEntry{{a[1], a[2]}}
+		getOption(3)
+	}
+	return tag, entries, option, nil
+}
+
+func forwardServe(db *Database, conn net.Conn, listener string) {
+	defer conn.Close()
+	client := conn.RemoteAddr().String()
+	peer := ""
+	if t, ok := conn.(*tls.Conn); ok {
+		if err := t.Handshake(); err != nil {
+			log.Printf("Forward TLS handshake with %s failed: %v\n", client, err)
+			return
+		}
+		if certs := t.ConnectionState().PeerCertificates; len(certs) > 0 {
+			peer = certs[0].Subject.CommonName
+		}
+	}
+	originatorIp, originatorPort := "", 0
+	if host, port, err := net.SplitHostPort(client); err == nil {
+		originatorIp = host
+		originatorPort, _ = strconv.Atoi(port)
+	}
+
+	d := newMsgpackDecoder(bufio.NewReader(conn))
+	for {
+		v, err := d.decode()
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Forward session with %s failed: %v\n", client, err)
+			}
+			return
+		}
+		tag, entries, option, err := forwardMessage(v)
+		if err != nil {
+			log.Printf("Forward session with %s failed: %v\n", client, err)
+			return
+		}
+
+		items := make([]*LogItem, 0, len(entries))
+		for _, e := range entries {
+			l, err := forwardLogItem(tag, e.time, e.record)
+			if err != nil {
+				log.Printf("Ignoring entry from %s: %v\n", client, err)
+				continue
+			}
+			l.OriginatorIp = originatorIp
+			l.OriginatorPort = originatorPort
+			l.ClientName = peer
+			l.Time = time.Now()
+			l.normalise()
+			l.assignShardGroup(listener)
+			items = append(items, l)
+		}
+
+		committed := func() (ok bool) {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("panic caught: %+v", err)
+					ok = false
+				}
+			}()
+			insertLogItems(db, items)
+			return true
+		}()
+		if !committed {
+			// Without an ack the sender will retry
+			return
+		}
+
+		if chunk := forwardString(option["chunk"]); chunk != "" {
+			ack := msgpackAppendString([]byte{0x81}, "ack")
+			ack = msgpackAppendString(ack, chunk)
+			if _, err := conn.Write(ack); err != nil {
+				log.Printf("Forward session with %s failed: %v\n", client, err)
+				return
+			}
+		}
+	}
+}
+
+func forwardServerStart(db *Database, listen string, tlsConfig *tls.Config) {
+	var ln net.Listener
+	var err error
+	if tlsConfig != nil {
+		ln, err = tls.Listen("tcp", listen, tlsConfig)
+	} else {
+		ln, err = net.Listen("tcp", listen)
+	}
+	if err != nil {
+		log.Fatalf("Cannot listen for Forward on %s: %v", listen, err)
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Cannot accept Forward connection on %s: %v\n", listen, err)
+			continue
+		}
+		go forwardServe(db, conn, listen)
+	}
+}
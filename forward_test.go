@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"testing"
+	"time"
+)
+
+// A msgpack map of string keys and values
+func forwardTestMap(kv ...string) []byte {
+	b := []byte{0x80 | byte(len(kv)/2)}
+	for _, s := range kv {
+		b = msgpackAppendString(b, s)
+	}
+	return b
+}
+
+// A msgpack [time, record] entry with an integer time
+func forwardTestEntry(t uint32, record []byte) []byte {
+	b := []byte{0x92, 0xce, byte(t >> 24), byte(t >> 16), byte(t >> 8), byte(t)}
+	return append(b, record...)
+}
+
+// A msgpack array of the given elements
+func forwardTestArray(elements ...[]byte) []byte {
+	b := []byte{0x90 | byte(len(elements))}
+	for _, e := range elements {
+		b = append(b, e...)
+	}
+	return b
+}
+
+func forwardTestBin(b []byte) []byte {
+	return append([]byte{0xc5, byte(len(b) >> 8), byte(len(b))}, b...)
+}
+
+func forwardTestGzip(b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestForwardMessage(t *testing.T) {
+	tag := msgpackAppendString(nil, "app")
+	record := forwardTestMap("log", "hello")
+	eventTime := []byte{0xd7, 0x00, 0, 0, 0, 10, 0, 0, 0, 5}
+	packed := append(forwardTestEntry(1, record), forwardTestEntry(2, record)...)
+	for _, tc := range []struct {
+		name    string
+		in      []byte
+		entries int
+		chunk   string
+	}{
+		{"message", forwardTestArray(tag, []byte{0xce, 0, 0, 0, 1}, record), 1, ""},
+		{"message with event time and chunk", forwardTestArray(tag, eventTime, record, forwardTestMap("chunk", "c1")), 1, "c1"},
+		{"forward", forwardTestArray(tag, forwardTestArray(forwardTestEntry(1, record), forwardTestEntry(2, record))), 2, ""},
+		{"forward with chunk", forwardTestArray(tag, forwardTestArray(forwardTestEntry(1, record)), forwardTestMap("chunk", "c2")), 1, "c2"},
+		{"packed forward", forwardTestArray(tag, forwardTestBin(packed)), 2, ""},
+		{"packed forward as str", forwardTestArray(tag, msgpackAppendString(nil, string(packed))), 2, ""},
+		{"compressed packed forward", forwardTestArray(tag, forwardTestBin(forwardTestGzip(packed)), forwardTestMap("compressed", "gzip", "chunk", "c3")), 2, "c3"},
+		{"empty forward", forwardTestArray(tag, forwardTestArray()), 0, ""},
+	} {
+		v, err := newMsgpackDecoder(bytes.NewReader(tc.in)).decode()
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		gotTag, entries, option, err := forwardMessage(v)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if gotTag != "app" || len(entries) != tc.entries || forwardString(option["chunk"]) != tc.chunk {
+			t.Errorf("%s: got tag %s, %d entries and chunk %q", tc.name, gotTag, len(entries), forwardString(option["chunk"]))
+		}
+	}
+}
+
+func TestForwardMessageMalformed(t *testing.T) {
+	tag := msgpackAppendString(nil, "app")
+	record := forwardTestMap("log", "hello")
+	packed := append(forwardTestEntry(1, record), forwardTestEntry(2, record)...)
+	for _, tc := range []struct {
+		name string
+		in   []byte
+	}{
+		{"not an array", record},
+		{"too short", forwardTestArray(tag)},
+		{"tag not a string", forwardTestArray([]byte{0x01}, forwardTestArray())},
+		{"message without record", forwardTestArray(tag, []byte{0x01})},
+		{"forward entry not a pair", forwardTestArray(tag, forwardTestArray(forwardTestArray([]byte{0x01})))},
+		{"forward entry not an array", forwardTestArray(tag, forwardTestArray([]byte{0x01}))},
+		{"packed entry not a pair", forwardTestArray(tag, forwardTestBin([]byte{0x91, 0x01}))},
+		{"packed entry truncated", forwardTestArray(tag, forwardTestBin(packed[:len(packed)-1]))},
+		{"packed entry corrupt", forwardTestArray(tag, forwardTestBin([]byte{0xc1}))},
+		{"compressed entries not gzip", forwardTestArray(tag, forwardTestBin(packed), forwardTestMap("compressed", "gzip"))},
+		{"compressed entries truncated", forwardTestArray(tag, forwardTestBin(forwardTestGzip(packed)[:20]), forwardTestMap("compressed", "gzip"))},
+	} {
+		v, err := newMsgpackDecoder(bytes.NewReader(tc.in)).decode()
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if _, entries, _, err := forwardMessage(v); err == nil {
+			t.Errorf("%s: accepted with %d entries", tc.name, len(entries))
+		}
+	}
+}
+
+func TestForwardTime(t *testing.T) {
+	for _, tc := range []struct {
+		in   interface{}
+		want time.Time
+		ok   bool
+	}{
+		{int64(10), time.Unix(10, 0), true},
+		{uint64(10), time.Unix(10, 0), true},
+		{float64(10.5), time.Unix(10, 500000000), true},
+		{msgpackExt{Type: 0, Data: []byte{0, 0, 0, 10, 0, 0, 0, 5}}, time.Unix(10, 5), true},
+		{msgpackExt{Type: 1, Data: []byte{0, 0, 0, 10, 0, 0, 0, 5}}, time.Time{}, false},
+		{msgpackExt{Type: 0, Data: []byte{0, 0, 0, 10}}, time.Time{}, false},
+		{"10", time.Time{}, false},
+	} {
+		got, ok := forwardTime(tc.in)
+		if ok != tc.ok || !got.Equal(tc.want) {
+			t.Errorf("%#v: got %v, %v, want %v, %v", tc.in, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestForwardLogItem(t *testing.T) {
+	record := map[string]interface{}{
+		"log":      []byte("hello"),
+		"level":    "info",
+		"hostname": "h",
+		"pid":      int64(42),
+		"user":     "u",
+		"k.x":      "v",
+		"n":        int64(7),
+	}
+	l, err := forwardLogItem("app", int64(10), record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Message != "hello" || l.Level != "info" || l.Hostname != "h" || l.Pid != 42 || l.User != "u" ||
+		l.AppName != "app" || !l.OriginatorTime.Equal(time.Unix(10, 0)) ||
+		l.Attributes["k_x"] != "v" || l.Attributes["n"] != "7" {
+		t.Errorf("got %+v", l)
+	}
+	if _, err := forwardLogItem("app", int64(10), []interface{}{}); err == nil {
+		t.Error("accepted a record which is not a map")
+	}
+}
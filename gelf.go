@@ -0,0 +1,360 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/*
+ * GELF 1.1 input, as sent by the Docker GELF log driver amongst others.
+ *
+ * Over UDP each datagram is a message, optionally gzip or zlib compressed,
+ * or a chunk of one. Chunks start with the magic bytes 0x1e 0x0f, then an
+ * 8 byte message id, the chunk's sequence number and the number of chunks
+ * (at most 128); the message is the concatenation of the chunks' payloads
+ * once all have arrived. At most gelfMaxPending messages, of at most
+ * gelfMaxBuffered bytes in all, are reassembled at once; chunks starting
+ * further messages are dropped until some complete or time out. Over TCP
+ * messages are uncompressed and terminated by a zero byte.
+ *
+ * The standard fields map onto LogItem fields as follows:
+ *
+ *   host -> hostname, short_message -> message, full_message -> exception,
+ *   timestamp -> timestamp, level -> level, facility -> facility,
+ *   _pid -> pid, _user -> user, _instance_id -> instance_id,
+ *   _account_group_id -> account_group_id
+ *
+ * Any other additional ('_') field is kept as an attribute, without its
+ * leading underscore.
+ */
+
+const (
+	gelfMaxChunks     = 128
+	gelfChunkTimeout  = 5 * time.Second
+	gelfMaxMessageLen = 1 * 1024 * 1024
+	gelfMaxPending    = 1000 // Chunked messages being reassembled at once
+	gelfMaxBuffered   = 32 * 1024 * 1024
+	gelfDefaultLevel  = 1 // Alert, as per the specification
+)
+
+var gelfChunkMagic = []byte{0x1e, 0x0f}
+
+type gelfChunks struct {
+	parts    [][]byte
+	received int
+	size     int
+	started  time.Time
+}
+
+// gelfAssembler reassembles chunked UDP messages
+type gelfAssembler struct {
+	mutex    sync.Mutex
+	messages map[uint64]*gelfChunks
+	buffered int // Bytes of chunks held in messages
+	expired  time.Time
+}
+
+func newGelfAssembler() *gelfAssembler {
+	return &gelfAssembler{messages: make(map[uint64]*gelfChunks), expired: time.Now()}
+}
+
+func (a *gelfAssembler) forget(id uint64) {
+	a.buffered -= a.messages[id].size
+	delete(a.messages, id)
+}
+
+// Add a datagram, returning the whole message if it completes one
+func (a *gelfAssembler) add(packet []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(packet, gelfChunkMagic) {
+		return packet, true
+	}
+	if len(packet) < 12 {
+		return nil, false
+	}
+	id := binary.BigEndian.Uint64(packet[2:10])
+	seq := int(packet[10])
+	count := int(packet[11])
+	if count == 0 || count > gelfMaxChunks || seq >= count {
+		return nil, false
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(a.expired) > time.Second {
+		// Forget messages whose chunks have not all arrived in time
+		for k, m := range a.messages {
+			if now.Sub(m.started) > gelfChunkTimeout {
+				a.forget(k)
+			}
+		}
+		a.expired = now
+	}
+
+	m, ok := a.messages[id]
+	if !ok {
+		if len(a.messages) >= gelfMaxPending || a.buffered >= gelfMaxBuffered {
+			return nil, false
+		}
+		m = &gelfChunks{parts: make([][]byte, count), started: now}
+		a.messages[id] = m
+	}
+	if len(m.parts) != count || m.parts[seq] != nil {
+		return nil, false
+	}
+	m.parts[seq] = append([]byte(nil), packet[12:]...)
+	m.received++
+	m.size += len(packet) - 12
+	a.buffered += len(packet) - 12
+	if m.size > gelfMaxMessageLen || a.buffered > gelfMaxBuffered {
+		a.forget(id)
+		return nil, false
+	}
+	if m.received < count {
+		return nil, false
+	}
+	a.forget(id)
+	return bytes.Join(m.parts, nil), true
+}
+
+func gelfDecompress(b []byte) ([]byte, error) {
+	var r io.Reader
+	switch {
+	case len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b:
+		gz, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		r = gz
+	case len(b) >= 2 && b[0] == 0x78 && (uint16(b[0])<<8|uint16(b[1]))%31 == 0:
+		z, err := zlib.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, err
+		}
+		r = z
+	default:
+		return b, nil
+	}
+	out, err := ioutil.ReadAll(io.LimitReader(r, gelfMaxMessageLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > gelfMaxMessageLen {
+		return nil, errors.New("GELF message too long")
+	}
+	return out, nil
+}
+
+func gelfInt(v interface{}) (int, bool) {
+	switch t := v.(type) {
+	case json.Number:
+		if f, err := t.Float64(); err == nil {
+			return int(f), true
+		}
+	case string:
+		if i, err := strconv.Atoi(t); err == nil {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Make a log item from a GELF message
+func gelfLogItem(b []byte) (*LogItem, error) {
+	var m map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&m); err != nil {
+		return nil, err
+	}
+
+	l := &LogItem{}
+	level := gelfDefaultLevel
+	for k, v := range m {
+		switch k {
+		case "version":
+		case "host":
+			l.Hostname = attributeString(v)
+		case "short_message":
+			l.Message = attributeString(v)
+		case "full_message":
+			l.Exception = attributeString(v)
+		case "timestamp":
+			if n, ok := v.(json.Number); ok {
+				if f, err := n.Float64(); err == nil {
+					// Round off floating point error to the microsecond
+					sec, frac := math.Modf(f)
+					l.OriginatorTime = time.Unix(int64(sec), int64(math.Floor(frac*1e6+0.5))*1e3)
+				}
+			}
+		case "level":
+			if i, ok := gelfInt(v); ok {
+				level = i
+			}
+		case "facility":
+			l.Facility = attributeString(v)
+		case "_pid":
+			if i, ok := gelfInt(v); ok {
+				l.Pid = i
+			}
+		case "_user":
+			l.User = attributeString(v)
+		case "_instance_id":
+			l.InstanceId = attributeString(v)
+		case "_account_group_id":
+			l.AccountGroupId = attributeString(v)
+		case "_id":
+			// Reserved by the specification
+		default:
+			if len(k) > 1 && k[0] == '_' {
+				l.setAttribute(k[1:], attributeString(v))
+			}
+		}
+	}
+	l.Level = levelToString(level)
+	return l, nil
+}
+
+// Chain items from a GELF service as they arrive, gathering whatever has
+// arrived together into one batch
+func gelfIngestRun(db *Database, ch chan *LogItem) {
+	for l := range ch {
+		batch := []*LogItem{l}
+	gather:
+		for len(batch) < ingestBatchSize {
+			select {
+			case l := <-ch:
+				batch = append(batch, l)
+			default:
+				break gather
+			}
+		}
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("panic caught: %+v", err)
+				}
+			}()
+			insertLogItems(db, batch)
+		}()
+	}
+}
+
+// Decode a GELF message and queue it for chaining
+func gelfReceive(ch chan *LogItem, b []byte, addr net.Addr, peer string, listener string) {
+	l, err := gelfLogItem(b)
+	if err != nil {
+		log.Printf("Cannot parse GELF message from %s: %v\n", addr, err)
+		return
+	}
+	if host, port, err := net.SplitHostPort(addr.String()); err == nil {
+		l.OriginatorIp = host
+		if p, err := strconv.Atoi(port); err == nil {
+			l.OriginatorPort = p
+		}
+	}
+	l.ClientName = peer
+	l.Time = time.Now()
+	l.normalise()
+	l.assignShardGroup(listener)
+	ch <- l
+}
+
+func gelfUDPServerStart(db *Database, listen string) {
+	conn, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		log.Fatalf("Cannot listen for GELF on %s: %v", listen, err)
+	}
+	ch := make(chan *LogItem, ingestBatchSize)
+	go gelfIngestRun(db, ch)
+	assembler := newGelfAssembler()
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			log.Printf("Cannot read GELF datagram on %s: %v\n", listen, err)
+			continue
+		}
+		msg, ok := assembler.add(buf[:n])
+		if !ok {
+			continue
+		}
+		if msg, err = gelfDecompress(msg); err != nil {
+			log.Printf("Cannot decompress GELF message from %s: %v\n", addr, err)
+			continue
+		}
+		gelfReceive(ch, msg, addr, "", listen)
+	}
+}
+
+func gelfServe(conn net.Conn, ch chan *LogItem, listener string) {
+	defer conn.Close()
+	peer := ""
+	if t, ok := conn.(*tls.Conn); ok {
+		if err := t.Handshake(); err != nil {
+			log.Printf("GELF TLS handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+			return
+		}
+		if certs := t.ConnectionState().PeerCertificates; len(certs) > 0 {
+			peer = certs[0].Subject.CommonName
+		}
+	}
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), gelfMaxMessageLen)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.IndexByte(data, 0); i >= 0 {
+			return i + 1, data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	})
+	for scanner.Scan() {
+		if len(scanner.Bytes()) > 0 {
+			gelfReceive(ch, scanner.Bytes(), conn.RemoteAddr(), peer, listener)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("GELF session with %s failed: %v\n", conn.RemoteAddr(), err)
+	}
+}
+
+func gelfTCPServerStart(db *Database, listen string, tlsConfig *tls.Config) {
+	var ln net.Listener
+	var err error
+	if tlsConfig != nil {
+		ln, err = tls.Listen("tcp", listen, tlsConfig)
+	} else {
+		ln, err = net.Listen("tcp", listen)
+	}
+	if err != nil {
+		log.Fatalf("Cannot listen for GELF on %s: %v", listen, err)
+	}
+	ch := make(chan *LogItem, ingestBatchSize)
+	go gelfIngestRun(db, ch)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Cannot accept GELF connection on %s: %v\n", listen, err)
+			continue
+		}
+		go gelfServe(conn, ch, listen)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+)
+
+func gelfTestChunk(id uint64, seq int, count int, payload string) []byte {
+	b := make([]byte, 12, 12+len(payload))
+	copy(b, gelfChunkMagic)
+	binary.BigEndian.PutUint64(b[2:10], id)
+	b[10] = byte(seq)
+	b[11] = byte(count)
+	return append(b, payload...)
+}
+
+func gelfTestGzip(b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func gelfTestZlib(b []byte) []byte {
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestGelfAssembler(t *testing.T) {
+	big := strings.Repeat("x", gelfMaxMessageLen/2+1)
+	for _, tc := range []struct {
+		name    string
+		packets [][]byte
+		want    string // The message completed by the last packet, if any
+	}{
+		{"not chunked", [][]byte{[]byte(`{"a":1}`)}, `{"a":1}`},
+		{"single chunk", [][]byte{gelfTestChunk(1, 0, 1, "abc")}, "abc"},
+		{"in order", [][]byte{gelfTestChunk(1, 0, 3, "a"), gelfTestChunk(1, 1, 3, "b"), gelfTestChunk(1, 2, 3, "c")}, "abc"},
+		{"out of order", [][]byte{gelfTestChunk(1, 2, 3, "c"), gelfTestChunk(1, 0, 3, "a"), gelfTestChunk(1, 1, 3, "b")}, "abc"},
+		{"duplicate", [][]byte{gelfTestChunk(1, 0, 2, "a"), gelfTestChunk(1, 0, 2, "x"), gelfTestChunk(1, 1, 2, "b")}, "ab"},
+		{"interleaved", [][]byte{gelfTestChunk(1, 0, 2, "a"), gelfTestChunk(2, 0, 2, "c"), gelfTestChunk(1, 1, 2, "b")}, "ab"},
+		{"most chunks", func() [][]byte {
+			var packets [][]byte
+			for i := 0; i < gelfMaxChunks; i++ {
+				packets = append(packets, gelfTestChunk(1, i, gelfMaxChunks, "a"))
+			}
+			return packets
+		}(), strings.Repeat("a", gelfMaxChunks)},
+		{"too many chunks", [][]byte{gelfTestChunk(1, 0, gelfMaxChunks+1, "a")}, ""},
+		{"no chunks", [][]byte{gelfTestChunk(1, 0, 0, "a")}, ""},
+		{"sequence beyond count", [][]byte{gelfTestChunk(1, 0, 2, "a"), gelfTestChunk(1, 2, 2, "b")}, ""},
+		{"count changed", [][]byte{gelfTestChunk(1, 0, 2, "a"), gelfTestChunk(1, 1, 3, "b")}, ""},
+		{"short header", [][]byte{gelfTestChunk(1, 0, 1, "")[:11]}, ""},
+		{"too long", [][]byte{gelfTestChunk(1, 0, 2, big), gelfTestChunk(1, 1, 2, big)}, ""},
+		{"too long, then the rest", [][]byte{gelfTestChunk(1, 0, 3, big), gelfTestChunk(1, 1, 3, big), gelfTestChunk(1, 2, 3, "c")}, ""},
+	} {
+		a := newGelfAssembler()
+		for i, p := range tc.packets {
+			msg, ok := a.add(p)
+			if i < len(tc.packets)-1 {
+				if ok {
+					t.Errorf("%s: completed by packet %d", tc.name, i)
+				}
+				continue
+			}
+			if ok != (tc.want != "") || string(msg) != tc.want {
+				t.Errorf("%s: got %q, %v", tc.name, msg, ok)
+			}
+		}
+	}
+}
+
+// Messages whose chunks do not all arrive in time are forgotten
+func TestGelfAssemblerTimeout(t *testing.T) {
+	a := newGelfAssembler()
+	a.add(gelfTestChunk(1, 0, 2, "a"))
+	a.add(gelfTestChunk(2, 0, 2, "c"))
+	a.messages[1].started = time.Now().Add(-2 * gelfChunkTimeout)
+	a.expired = time.Now().Add(-2 * time.Second)
+	if _, ok := a.add(gelfTestChunk(1, 1, 2, "b")); ok {
+		t.Error("timed out message completed")
+	}
+	if msg, ok := a.add(gelfTestChunk(2, 1, 2, "d")); !ok || string(msg) != "cd" {
+		t.Errorf("message in time got %q, %v", msg, ok)
+	}
+	if len(a.messages) != 1 || a.buffered != 1 {
+		t.Errorf("%d messages of %d bytes left", len(a.messages), a.buffered)
+	}
+}
+
+// Chunks starting messages beyond the limits are dropped
+func TestGelfAssemblerLimits(t *testing.T) {
+	a := newGelfAssembler()
+	for id := uint64(0); id < gelfMaxPending; id++ {
+		a.add(gelfTestChunk(id, 0, 2, "a"))
+	}
+	if _, ok := a.add(gelfTestChunk(gelfMaxPending, 0, 1, "a")); ok {
+		t.Error("message beyond the limit on messages accepted")
+	}
+	if msg, ok := a.add(gelfTestChunk(0, 1, 2, "b")); !ok || string(msg) != "ab" {
+		t.Errorf("message within the limit got %q, %v", msg, ok)
+	}
+	if _, ok := a.add(gelfTestChunk(gelfMaxPending, 0, 1, "a")); !ok {
+		t.Error("message refused once under the limit on messages")
+	}
+
+	a = newGelfAssembler()
+	chunk := strings.Repeat("x", gelfMaxMessageLen/2)
+	n := uint64(gelfMaxBuffered / len(chunk))
+	for id := uint64(0); id < n; id++ {
+		a.add(gelfTestChunk(id, 0, 2, chunk))
+	}
+	if a.buffered != gelfMaxBuffered {
+		t.Fatalf("%d bytes buffered", a.buffered)
+	}
+	if _, ok := a.add(gelfTestChunk(n, 0, 1, "a")); ok {
+		t.Error("message beyond the limit on bytes accepted")
+	}
+	if msg, ok := a.add(gelfTestChunk(0, 1, 2, "b")); ok || a.messages[0] != nil {
+		t.Errorf("chunk beyond the limit on bytes got %d bytes, %v", len(msg), ok)
+	}
+	if _, ok := a.add(gelfTestChunk(n, 0, 1, "a")); !ok {
+		t.Error("message refused once under the limit on bytes")
+	}
+	if a.buffered != int(n-1)*len(chunk) {
+		t.Errorf("%d bytes buffered", a.buffered)
+	}
+}
+
+func TestGelfDecompress(t *testing.T) {
+	msg := []byte(`{"short_message":"hello"}`)
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{"none", msg, msg},
+		{"gzip", gelfTestGzip(msg), msg},
+		{"zlib", gelfTestZlib(msg), msg},
+		{"x but not zlib", []byte("xyz"), []byte("xyz")},
+		{"empty", []byte{}, []byte{}},
+		{"gzip at the limit", gelfTestGzip(make([]byte, gelfMaxMessageLen)), make([]byte, gelfMaxMessageLen)},
+	} {
+		got, err := gelfDecompress(tc.in)
+		if err != nil || !bytes.Equal(got, tc.want) {
+			t.Errorf("%s: got %d bytes, %v", tc.name, len(got), err)
+		}
+	}
+
+	gz := gelfTestGzip(msg)
+	zl := gelfTestZlib(msg)
+	for _, tc := range []struct {
+		name string
+		in   []byte
+	}{
+		{"truncated gzip", gz[:len(gz)-4]},
+		{"corrupt gzip", append(append([]byte(nil), gz[:10]...), 0xff, 0xff, 0xff)},
+		{"gzip header only", gz[:2]},
+		{"truncated zlib", zl[:len(zl)-2]},
+		{"gzip too long", gelfTestGzip(make([]byte, gelfMaxMessageLen+1))},
+		{"zlib too long", gelfTestZlib(make([]byte, gelfMaxMessageLen+1))},
+	} {
+		if got, err := gelfDecompress(tc.in); err == nil {
+			t.Errorf("%s: decompressed to %q", tc.name, got)
+		}
+	}
+}
+
+func TestGelfLogItem(t *testing.T) {
+	initFieldProperties()
+	for _, tc := range []struct {
+		in    string
+		check func(l *LogItem) bool
+	}{
+		{`{"version":"1.1","host":"h","short_message":"s","full_message":"f"}`,
+			func(l *LogItem) bool {
+				return l.Hostname == "h" && l.Message == "s" && l.Exception == "f" && l.Level == "alert" && l.Attributes == nil
+			}},
+		{`{"short_message":"s","level":3}`, func(l *LogItem) bool { return l.Level == "err" }},
+		{`{"short_message":"s","level":"6"}`, func(l *LogItem) bool { return l.Level == "info" }},
+		{`{"short_message":"s","level":"high"}`, func(l *LogItem) bool { return l.Level == "alert" }},
+		{`{"short_message":"s","level":42}`, func(l *LogItem) bool { return l.Level == levelToString(-1) }},
+		{`{"short_message":"s","timestamp":1385053862.3072}`,
+			func(l *LogItem) bool { return l.OriginatorTime.Equal(time.Unix(1385053862, 307200000)) }},
+		{`{"short_message":"s","timestamp":1385053862}`,
+			func(l *LogItem) bool { return l.OriginatorTime.Equal(time.Unix(1385053862, 0)) }},
+		{`{"short_message":"s","timestamp":"1385053862"}`, func(l *LogItem) bool { return l.OriginatorTime.IsZero() }},
+		{`{"short_message":"s","_pid":12}`, func(l *LogItem) bool { return l.Pid == 12 && l.Attributes == nil }},
+		{`{"short_message":"s","_pid":"12"}`, func(l *LogItem) bool { return l.Pid == 12 }},
+		{`{"short_message":"s","_pid":"abc"}`, func(l *LogItem) bool { return l.Pid == 0 && l.Attributes == nil }},
+		{`{"short_message":"s","_user":"u","_instance_id":"i","_account_group_id":"g","facility":"f"}`,
+			func(l *LogItem) bool {
+				return l.User == "u" && l.InstanceId == "i" && l.AccountGroupId == "g" && l.Facility == "f" && l.Attributes == nil
+			}},
+		{`{"short_message":"s","_id":"x","_":"y","other":"z"}`, func(l *LogItem) bool { return l.Attributes == nil }},
+		{`{"short_message":"s","_container.name":"c","_n":42.5,"_b":true,"_o":{"a":1},"_z":null}`,
+			func(l *LogItem) bool {
+				return len(l.Attributes) == 5 && l.Attributes["container_name"] == "c" && l.Attributes["n"] == "42.5" &&
+					l.Attributes["b"] == "true" && l.Attributes["o"] == `{"a":1}` && l.Attributes["z"] == ""
+			}},
+		{`{"short_message":12}`, func(l *LogItem) bool { return l.Message == "12" }},
+	} {
+		l, err := gelfLogItem([]byte(tc.in))
+		if err != nil {
+			t.Errorf("%s: %v", tc.in, err)
+			continue
+		}
+		if !tc.check(l) {
+			t.Errorf("%s: got %+v", tc.in, l)
+		}
+	}
+
+	for _, bad := range []string{``, `{`, `[1]`, `"s"`, `{"short_message":}`} {
+		if l, err := gelfLogItem([]byte(bad)); err == nil {
+			t.Errorf("%s: accepted as %+v", bad, l)
+		}
+	}
+}
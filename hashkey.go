@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+/*
+ * The hash keyring. Each item records in KeyId the id of the key its hash
+ * was made with, so old keys must be kept in the keyring for as long as
+ * items hashed with them need to verify. New items are hashed with the key
+ * most recently active (i.e. with the latest active_from not in the future),
+ * which allows rotations to be scheduled in advance.
+ *
+ * The legacy 'hashsecret' configuration option is the key with an empty id,
+ * which is the id of every item created before the keyring existed.
+ */
+
+type hashKey struct {
+	id         string
+	secret     string
+	activeFrom time.Time
+}
+
+var hashKeys []hashKey
+
+func addHashKey(k hashKey) error {
+	if k.secret == "" {
+		return errors.New("hash secrets must not be empty")
+	}
+	if _, ok := findHashKey(k.id); ok {
+		return fmt.Errorf("duplicate hash secret id '%s'", k.id)
+	}
+	hashKeys = append(hashKeys, k)
+	sort.SliceStable(hashKeys, func(i, j int) bool {
+		return hashKeys[i].activeFrom.Before(hashKeys[j].activeFrom)
+	})
+	return nil
+}
+
+func findHashKey(id string) (*hashKey, bool) {
+	for i := range hashKeys {
+		if hashKeys[i].id == id {
+			return &hashKeys[i], true
+		}
+	}
+	return nil, false
+}
+
+// The key to use for new items at a given time
+func activeHashKey(t time.Time) (*hashKey, bool) {
+	for i := len(hashKeys) - 1; i >= 0; i-- {
+		if !hashKeys[i].activeFrom.After(t) {
+			return &hashKeys[i], true
+		}
+	}
+	return nil, false
+}
+
+// The secret an item was (or is to be) hashed with, and whether the item's
+// key is in the keyring at all
+func (l *LogItem) hashSecret() (string, bool) {
+	if k, ok := findHashKey(l.KeyId); ok {
+		return k.secret, true
+	}
+	return "", false
+}
+
+// Record a key rotation in the chain itself. The marker is hashed with the
+// new key and links to the last item hashed with the old one.
+func newKeyRotationItem(from string, to string) *LogItem {
+	l := &LogItem{
+		Message:  fmt.Sprintf("Hash key rotated from '%s' to '%s'", from, to),
+		Facility: "slogger",
+		Level:    "notice",
+	}
+	l.normalise()
+	l.roundTimes()
+	return l
+}
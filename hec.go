@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ * A Splunk HTTP Event Collector (HEC) compatible endpoint on the rest
+ * service, for senders which can only speak HEC:
+ *
+ *   POST /services/collector[/event]  one or more JSON events, concatenated
+ *   POST /services/collector/raw      text, one event per line
+ *   POST /services/collector/ack      indexer acknowledgement status
+ *   GET  /services/collector/health
+ *
+ * Senders authenticate with "Authorization: Splunk <token>" (or basic
+ * authentication with the token as the password), the token being one
+ * configured under 'hectokens'. The token's name becomes the client_name
+ * of its items unless a TLS client certificate gives one.
+ *
+ * Event fields map onto LogItem fields as follows:
+ *
+ *   event -> message (JSON unless it is a string), host -> hostname,
+ *   source -> app_name, time -> timestamp
+ *
+ * and sourcetype, index and any indexed 'fields' are kept as attributes.
+ * The host, source, sourcetype and index query parameters give defaults.
+ *
+ * A request's events are committed to the chain together, and only then
+ * do we reply. If the sender gives a channel (X-Splunk-Request-Channel) the
+ * reply carries an ackId, which /ack reports as acknowledged (once, as
+ * Splunk does) only if it was issued on that channel by this instance.
+ * Senders must therefore stick to one instance per channel. We remember at
+ * most hecMaxAcks unqueried ackIds per channel, for at most hecMaxChannels
+ * channels, forgetting the oldest first.
+ */
+
+const (
+	hecMaxBodyLen  = 16 * 1024 * 1024
+	hecMaxAcks     = 10000
+	hecMaxChannels = 1000
+)
+
+// HEC status codes
+const (
+	hecSuccess            = 0
+	hecTokenRequired      = 2
+	hecInvalidAuth        = 3
+	hecInvalidToken       = 4
+	hecNoData             = 5
+	hecInvalidDataFormat  = 6
+	hecEventFieldRequired = 12
+	hecEventFieldBlank    = 13
+	hecHealthy            = 17
+)
+
+var hecStatusText = map[int]string{
+	hecSuccess:            "Success",
+	hecTokenRequired:      "Token is required",
+	hecInvalidAuth:        "Invalid authorization",
+	hecInvalidToken:       "Invalid token",
+	hecNoData:             "No data",
+	hecInvalidDataFormat:  "Invalid data format",
+	hecEventFieldRequired: "Event field is required",
+	hecEventFieldBlank:    "Event field cannot be blank",
+	hecHealthy:            "HEC is healthy",
+}
+
+type hecToken struct {
+	token string
+	name  string
+}
+
+var hecTokens = make(map[string]string) // Token to name
+
+// The ackIds issued on a channel and not yet reported, oldest first
+type hecChannelAcks struct {
+	ids      []int64
+	lastUsed time.Time
+}
+
+var (
+	hecAcksMutex sync.Mutex
+	hecNextAckId int64
+	hecAcks      = make(map[string]*hecChannelAcks)
+)
+
+// Issue an ackId on a channel for events which have been committed
+func hecIssueAck(channel string) int64 {
+	hecAcksMutex.Lock()
+	defer hecAcksMutex.Unlock()
+	acks, ok := hecAcks[channel]
+	if !ok {
+		if len(hecAcks) >= hecMaxChannels {
+			// Forget the channel used least recently
+			var oldest string
+			for ch, a := range hecAcks {
+				if oldest == "" || a.lastUsed.Before(hecAcks[oldest].lastUsed) {
+					oldest = ch
+				}
+			}
+			delete(hecAcks, oldest)
+		}
+		acks = &hecChannelAcks{}
+		hecAcks[channel] = acks
+	}
+	id := hecNextAckId
+	hecNextAckId++
+	acks.ids = append(acks.ids, id)
+	if len(acks.ids) > hecMaxAcks {
+		acks.ids = acks.ids[len(acks.ids)-hecMaxAcks:]
+	}
+	acks.lastUsed = time.Now()
+	return id
+}
+
+// Whether an ackId was issued on a channel, forgetting it if so
+func hecQueryAck(channel string, id int64) bool {
+	hecAcksMutex.Lock()
+	defer hecAcksMutex.Unlock()
+	acks, ok := hecAcks[channel]
+	if !ok {
+		return false
+	}
+	acks.lastUsed = time.Now()
+	for i, issued := range acks.ids {
+		if issued == id {
+			acks.ids = append(acks.ids[:i], acks.ids[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+type hecEvent struct {
+	Time       json.Number            `json:"time"`
+	Host       string                 `json:"host"`
+	Source     string                 `json:"source"`
+	SourceType string                 `json:"sourcetype"`
+	Index      string                 `json:"index"`
+	Event      json.RawMessage        `json:"event"`
+	Fields     map[string]interface{} `json:"fields"`
+}
+
+func hecReply(w http.ResponseWriter, status int, code int, extra map[string]interface{}) {
+	reply := map[string]interface{}{"text": hecStatusText[code], "code": code}
+	for k, v := range extra {
+		reply[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		panic(err)
+	}
+}
+
+// Check the request's token, replying with an error and returning false if
+// it is not a configured one
+func hecAuthenticate(w http.ResponseWriter, r *http.Request) (string, bool) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		hecReply(w, http.StatusUnauthorized, hecTokenRequired, nil)
+		return "", false
+	}
+	var token string
+	if _, password, ok := r.BasicAuth(); ok {
+		token = password
+	} else if fields := strings.Fields(auth); len(fields) == 2 && fields[0] == "Splunk" {
+		token = fields[1]
+	} else {
+		hecReply(w, http.StatusUnauthorized, hecInvalidAuth, nil)
+		return "", false
+	}
+	name, ok := hecTokens[token]
+	if !ok {
+		hecReply(w, http.StatusForbidden, hecInvalidToken, nil)
+		return "", false
+	}
+	return name, true
+}
+
+// Parse a time in seconds since the epoch, to the microsecond
+func hecTime(n json.Number) (time.Time, bool) {
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	sec, frac := math.Modf(f)
+	return time.Unix(int64(sec), int64(math.Floor(frac*1e6+0.5))*1e3), true
+}
+
+// Make a log item from an event, with defaults from the query parameters
+func (e *hecEvent) logItem(r *http.Request) (*LogItem, int) {
+	q := r.URL.Query()
+	for _, d := range []struct {
+		field *string
+		param string
+	}{{&e.Host, "host"}, {&e.Source, "source"}, {&e.SourceType, "sourcetype"}, {&e.Index, "index"}} {
+		if *d.field == "" {
+			*d.field = q.Get(d.param)
+		}
+	}
+
+	l := &LogItem{Hostname: e.Host, AppName: e.Source}
+	if e.Time != "" {
+		t, ok := hecTime(e.Time)
+		if !ok {
+			return nil, hecInvalidDataFormat
+		}
+		l.OriginatorTime = t
+	}
+
+	if len(e.Event) == 0 || string(e.Event) == "null" {
+		return nil, hecEventFieldRequired
+	}
+	var s string
+	if err := json.Unmarshal(e.Event, &s); err == nil {
+		l.Message = s
+	} else {
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, e.Event); err != nil {
+			return nil, hecInvalidDataFormat
+		}
+		l.Message = buf.String()
+	}
+	if strings.TrimSpace(l.Message) == "" {
+		return nil, hecEventFieldBlank
+	}
+
+	if e.SourceType != "" {
+		l.setAttribute("sourcetype", e.SourceType)
+	}
+	if e.Index != "" {
+		l.setAttribute("index", e.Index)
+	}
+	for k, v := range e.Fields {
+		l.setAttribute(k, attributeString(v))
+	}
+	return l, hecSuccess
+}
+
+// Commit the items and reply, with an ackId if the sender gave a channel
+func hecCommit(c *Context, w http.ResponseWriter, r *http.Request, items []*LogItem, name string) {
+	for _, l := range items {
+		l.setRequestOrigin(r)
+		if l.ClientName == "" {
+			l.ClientName = name
+		}
+		l.normalise()
+		l.assignShardGroup(c.listener)
+	}
+	insertLogItems(c.db, items)
+
+	var extra map[string]interface{}
+	if channel := hecChannel(r); channel != "" {
+		extra = map[string]interface{}{"ackId": hecIssueAck(channel)}
+	}
+	hecReply(w, http.StatusOK, hecSuccess, extra)
+}
+
+func hecChannel(r *http.Request) string {
+	if channel := r.Header.Get("X-Splunk-Request-Channel"); channel != "" {
+		return channel
+	}
+	return r.URL.Query().Get("channel")
+}
+
+func hecReadBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	body, err := readRequestBody(r, hecMaxBodyLen)
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+	if err != nil {
+		hecReply(w, http.StatusBadRequest, hecInvalidDataFormat, nil)
+		return nil, false
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		hecReply(w, http.StatusBadRequest, hecNoData, nil)
+		return nil, false
+	}
+	return body, true
+}
+
+func hecEventHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	name, ok := hecAuthenticate(w, r)
+	if !ok {
+		r.Body.Close()
+		return
+	}
+	body, ok := hecReadBody(w, r)
+	if !ok {
+		return
+	}
+
+	// Events are concatenated JSON objects, not an array
+	var items []*LogItem
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	for i := 0; ; i++ {
+		var e hecEvent
+		if err := d.Decode(&e); err == io.EOF {
+			break
+		} else if err != nil {
+			hecReply(w, http.StatusBadRequest, hecInvalidDataFormat, map[string]interface{}{"invalid-event-number": i})
+			return
+		}
+		l, code := e.logItem(r)
+		if code != hecSuccess {
+			hecReply(w, http.StatusBadRequest, code, map[string]interface{}{"invalid-event-number": i})
+			return
+		}
+		items = append(items, l)
+	}
+	hecCommit(c, w, r, items, name)
+}
+
+func hecRawHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	name, ok := hecAuthenticate(w, r)
+	if !ok {
+		r.Body.Close()
+		return
+	}
+	body, ok := hecReadBody(w, r)
+	if !ok {
+		return
+	}
+
+	var items []*LogItem
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 64*1024), hecMaxBodyLen)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		event, _ := json.Marshal(line)
+		e := hecEvent{Event: event}
+		l, code := e.logItem(r)
+		if code != hecSuccess {
+			hecReply(w, http.StatusBadRequest, code, nil)
+			return
+		}
+		items = append(items, l)
+	}
+	hecCommit(c, w, r, items, name)
+}
+
+func hecAckHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if _, ok := hecAuthenticate(w, r); !ok {
+		r.Body.Close()
+		return
+	}
+	body, ok := hecReadBody(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Acks []int64 `json:"acks"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		hecReply(w, http.StatusBadRequest, hecInvalidDataFormat, nil)
+		return
+	}
+	channel := hecChannel(r)
+	acks := make(map[string]bool)
+	for _, id := range req.Acks {
+		acks[strconv.FormatInt(id, 10)] = hecQueryAck(channel, id)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"acks": acks}); err != nil {
+		panic(err)
+	}
+}
+
+func hecHealthHandler(c *Context, w http.ResponseWriter, r *http.Request) {
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+	hecReply(w, http.StatusOK, hecHealthy, nil)
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func hecTestSetup(t *testing.T) {
+	initFieldProperties()
+	savedTokens, savedAcks, savedNext := hecTokens, hecAcks, hecNextAckId
+	hecTokens = map[string]string{"tok": "appliance"}
+	hecAcks = make(map[string]*hecChannelAcks)
+	hecNextAckId = 0
+	t.Cleanup(func() { hecTokens, hecAcks, hecNextAckId = savedTokens, savedAcks, savedNext })
+}
+
+func hecTestCode(t *testing.T, w *httptest.ResponseRecorder) int {
+	var reply struct {
+		Code int `json:"code"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+		t.Fatalf("bad reply %s", w.Body.String())
+	}
+	return reply.Code
+}
+
+func TestHecAuthenticate(t *testing.T) {
+	hecTestSetup(t)
+	for _, tc := range []struct {
+		name   string
+		header string
+		user   string // Basic authentication, if set
+		ok     bool
+		status int
+		code   int
+	}{
+		{"missing header", "", "", false, http.StatusUnauthorized, hecTokenRequired},
+		{"Splunk token", "Splunk tok", "", true, http.StatusOK, hecSuccess},
+		{"Splunk token with spaces", "Splunk   tok ", "", true, http.StatusOK, hecSuccess},
+		{"basic authentication", "", "tok", true, http.StatusOK, hecSuccess},
+		{"unknown Splunk token", "Splunk other", "", false, http.StatusForbidden, hecInvalidToken},
+		{"unknown basic password", "", "other", false, http.StatusForbidden, hecInvalidToken},
+		{"no token", "Splunk", "", false, http.StatusUnauthorized, hecInvalidAuth},
+		{"other scheme", "Bearer tok", "", false, http.StatusUnauthorized, hecInvalidAuth},
+		{"lower case scheme", "splunk tok", "", false, http.StatusUnauthorized, hecInvalidAuth},
+		{"extra fields", "Splunk tok tok", "", false, http.StatusUnauthorized, hecInvalidAuth},
+	} {
+		r := httptest.NewRequest("POST", "/services/collector", nil)
+		if tc.header != "" {
+			r.Header.Set("Authorization", tc.header)
+		}
+		if tc.user != "" {
+			r.SetBasicAuth("x", tc.user)
+		}
+		w := httptest.NewRecorder()
+		name, ok := hecAuthenticate(w, r)
+		if ok != tc.ok {
+			t.Errorf("%s: ok %v", tc.name, ok)
+			continue
+		}
+		if ok {
+			if name != "appliance" || w.Body.Len() != 0 {
+				t.Errorf("%s: name %q and reply %s", tc.name, name, w.Body.String())
+			}
+			continue
+		}
+		if w.Code != tc.status || hecTestCode(t, w) != tc.code {
+			t.Errorf("%s: got %d %s", tc.name, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestHecEventLogItem(t *testing.T) {
+	hecTestSetup(t)
+	for _, tc := range []struct {
+		event string
+		query string
+		code  int
+		check func(l *LogItem) bool
+	}{
+		{`{"event":"hello"}`, "", hecSuccess, func(l *LogItem) bool {
+			return l.Message == "hello" && l.Hostname == "" && l.AppName == "" && l.OriginatorTime.IsZero() && l.Attributes == nil
+		}},
+		{`{"event":{"b": "x", "a": [1, 2]}}`, "", hecSuccess, func(l *LogItem) bool { return l.Message == `{"b":"x","a":[1,2]}` }},
+		{`{"event":42}`, "", hecSuccess, func(l *LogItem) bool { return l.Message == "42" }},
+		{`{"event":"hello","time":"1426279439.123"}`, "", hecSuccess,
+			func(l *LogItem) bool { return l.OriginatorTime.Equal(time.Unix(1426279439, 123000000)) }},
+		{`{"event":"hello","time":1426279439.5}`, "", hecSuccess,
+			func(l *LogItem) bool { return l.OriginatorTime.Equal(time.Unix(1426279439, 500000000)) }},
+		{`{"event":"hello","time":1426279439}`, "", hecSuccess,
+			func(l *LogItem) bool { return l.OriginatorTime.Equal(time.Unix(1426279439, 0)) }},
+		{`{"event":"hello","host":"h","source":"s","sourcetype":"st","index":"i"}`, "host=qh&source=qs&sourcetype=qst&index=qi", hecSuccess,
+			func(l *LogItem) bool {
+				return l.Hostname == "h" && l.AppName == "s" && l.Attributes["sourcetype"] == "st" && l.Attributes["index"] == "i"
+			}},
+		{`{"event":"hello"}`, "host=qh&source=qs&sourcetype=qst&index=qi", hecSuccess,
+			func(l *LogItem) bool {
+				return l.Hostname == "qh" && l.AppName == "qs" && l.Attributes["sourcetype"] == "qst" && l.Attributes["index"] == "qi"
+			}},
+		{`{"event":"hello","fields":{"f.1":"v","n":[1,2],"x":3.5,"b":false}}`, "", hecSuccess,
+			func(l *LogItem) bool {
+				return reflect.DeepEqual(l.Attributes, map[string]string{"f_1": "v", "n": "[1,2]", "x": "3.5", "b": "false"})
+			}},
+		{`{}`, "", hecEventFieldRequired, nil},
+		{`{"event":null}`, "", hecEventFieldRequired, nil},
+		{`{"event":""}`, "", hecEventFieldBlank, nil},
+		{`{"event":"  \t"}`, "", hecEventFieldBlank, nil},
+	} {
+		d := json.NewDecoder(strings.NewReader(tc.event))
+		d.UseNumber()
+		var e hecEvent
+		if err := d.Decode(&e); err != nil {
+			t.Fatalf("%s: %v", tc.event, err)
+		}
+		l, code := e.logItem(httptest.NewRequest("POST", "/services/collector?"+tc.query, nil))
+		if code != tc.code {
+			t.Errorf("%s: code %d, want %d", tc.event, code, tc.code)
+			continue
+		}
+		if tc.check != nil && !tc.check(l) {
+			t.Errorf("%s: got %+v", tc.event, l)
+		}
+	}
+
+	// The JSON decoder already refuses such times, so set one directly
+	e := hecEvent{Event: json.RawMessage(`"hello"`), Time: "soon"}
+	if _, code := e.logItem(httptest.NewRequest("POST", "/services/collector", nil)); code != hecInvalidDataFormat {
+		t.Errorf("bad time: code %d", code)
+	}
+}
+
+func TestHecAcks(t *testing.T) {
+	hecTestSetup(t)
+	id := hecIssueAck("ch1")
+	other := hecIssueAck("ch2")
+	if id == other {
+		t.Fatal("ackId issued twice")
+	}
+	for _, tc := range []struct {
+		name    string
+		channel string
+		id      int64
+		want    bool
+	}{
+		{"wrong channel", "ch2", id, false},
+		{"unknown channel", "ch3", id, false},
+		{"no channel", "", id, false},
+		{"never issued", "ch1", other + 1, false},
+		{"issued", "ch1", id, true},
+		{"already reported", "ch1", id, false},
+		{"other channel's", "ch2", other, true},
+	} {
+		if got := hecQueryAck(tc.channel, tc.id); got != tc.want {
+			t.Errorf("%s: got %v", tc.name, got)
+		}
+	}
+}
+
+// The oldest ackIds on a channel are forgotten beyond hecMaxAcks
+func TestHecAcksPerChannel(t *testing.T) {
+	hecTestSetup(t)
+	first := hecIssueAck("ch")
+	second := hecIssueAck("ch")
+	var last int64
+	for i := 0; i < hecMaxAcks-1; i++ {
+		last = hecIssueAck("ch")
+	}
+	if len(hecAcks["ch"].ids) != hecMaxAcks {
+		t.Errorf("%d ackIds remembered", len(hecAcks["ch"].ids))
+	}
+	if hecQueryAck("ch", first) || !hecQueryAck("ch", second) || !hecQueryAck("ch", last) {
+		t.Error("wrong ackIds forgotten")
+	}
+}
+
+// The channels used least recently are forgotten beyond hecMaxChannels
+func TestHecAcksChannels(t *testing.T) {
+	hecTestSetup(t)
+	start := time.Now().Add(-time.Hour)
+	ids := make([]int64, hecMaxChannels)
+	for i := range ids {
+		channel := fmt.Sprintf("ch%d", i)
+		ids[i] = hecIssueAck(channel)
+		hecAcks[channel].lastUsed = start.Add(time.Duration(i) * time.Second)
+	}
+	// Querying a channel counts as using it
+	hecQueryAck("ch0", -1)
+	hecIssueAck("new")
+	if len(hecAcks) != hecMaxChannels || hecAcks["ch1"] != nil {
+		t.Errorf("%d channels, including ch1 %v", len(hecAcks), hecAcks["ch1"] != nil)
+	}
+	if !hecQueryAck("ch0", ids[0]) || hecQueryAck("ch1", ids[1]) || !hecQueryAck("ch2", ids[2]) {
+		t.Error("wrong channel forgotten")
+	}
+}
+
+func TestHecAckHandler(t *testing.T) {
+	hecTestSetup(t)
+	id := hecIssueAck("ch1")
+	for _, tc := range []struct {
+		name    string
+		body    string
+		channel string
+		status  int
+		want    map[string]bool
+	}{
+		{"issued", fmt.Sprintf(`{"acks":[%d,%d]}`, id, id+1), "ch1", http.StatusOK, map[string]bool{fmt.Sprint(id): true, fmt.Sprint(id + 1): false}},
+		{"reported", fmt.Sprintf(`{"acks":[%d]}`, id), "ch1", http.StatusOK, map[string]bool{fmt.Sprint(id): false}},
+		{"no data", "", "ch1", http.StatusBadRequest, nil},
+		{"bad data", `{"acks":["x"]}`, "ch1", http.StatusBadRequest, nil},
+	} {
+		r := httptest.NewRequest("POST", "/services/collector/ack", bytes.NewBufferString(tc.body))
+		r.Header.Set("Authorization", "Splunk tok")
+		r.Header.Set("X-Splunk-Request-Channel", tc.channel)
+		w := httptest.NewRecorder()
+		hecAckHandler(&Context{}, w, r)
+		if w.Code != tc.status {
+			t.Errorf("%s: got %d %s", tc.name, w.Code, w.Body.String())
+			continue
+		}
+		if tc.want == nil {
+			continue
+		}
+		var reply struct {
+			Acks map[string]bool `json:"acks"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil || !reflect.DeepEqual(reply.Acks, tc.want) {
+			t.Errorf("%s: got %s", tc.name, w.Body.String())
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
@@ -25,8 +27,9 @@ type Route struct {
 }
 
 type Context struct {
-	route Route
-	db    *Database
+	route    Route
+	db       *Database
+	listener string
 }
 
 type ContextHandlerFunc func(c *Context, w http.ResponseWriter, r *http.Request)
@@ -40,12 +43,102 @@ var routes = Routes{
 		"/logitem/create",
 		createLogItem,
 	},
+	Route{
+		"BulkCreateLogItem",
+		"POST",
+		"/logitem/bulk",
+		bulkCreateLogItem,
+	},
+	Route{
+		"OtlpLogs",
+		"POST",
+		"/v1/logs",
+		otlpLogs,
+	},
+	Route{
+		"HecEvent",
+		"POST",
+		"/services/collector",
+		hecEventHandler,
+	},
+	Route{
+		"HecEvent",
+		"POST",
+		"/services/collector/event",
+		hecEventHandler,
+	},
+	Route{
+		"HecRaw",
+		"POST",
+		"/services/collector/raw",
+		hecRawHandler,
+	},
+	Route{
+		"HecAck",
+		"POST",
+		"/services/collector/ack",
+		hecAckHandler,
+	},
+	Route{
+		"HecHealth",
+		"GET",
+		"/services/collector/health",
+		hecHealthHandler,
+	},
+	Route{
+		"LokiPush",
+		"POST",
+		"/loki/api/v1/push",
+		lokiPush,
+	},
 	Route{
 		"QueryLogItem",
 		"GET",
 		"/logitem/query",
 		queryLogItem,
 	},
+	Route{
+		"VerifyLogItem",
+		"GET",
+		"/logitem/verify",
+		verifyLogItem,
+	},
+	Route{
+		"ProofLogItem",
+		"GET",
+		"/logitem/proof",
+		proofLogItem,
+	},
+	Route{
+		"ConsistencyLogItem",
+		"GET",
+		"/logitem/consistency",
+		consistencyLogItem,
+	},
+	Route{
+		"QueryShardIndex",
+		"GET",
+		"/shardindex",
+		shardIndex,
+	},
+	Route{
+		"QueryCheckpoints",
+		"GET",
+		"/checkpoints",
+		queryCheckpoint,
+	},
+	Route{
+		"CheckpointPublicKey",
+		"GET",
+		"/checkpoints/publickey",
+		checkpointPublicKey,
+	},
+	Route{
+		"Metrics",
+		"GET",
+		"/debug/vars",
+		metrics,
+	},
 }
 
 /*
@@ -120,9 +213,33 @@ func jsonToDbKeys(i *interface{}) error {
 	if m, ok := (*i).(map[string]interface{}); ok {
 		// fix up a map
 		nm := make(map[string]interface{})
+		var sdClauses []interface{}
 		for k, v := range m {
 			// First see if it is a valid field name and if so translate it
-			if jk, ok := jsonMap[k]; ok && !hasFieldProperty(jk, fpNoQuery) {
+			if clause, ok := sdQuery(k, v); ok {
+				// A structured data param takes a value as for a field
+				switch t := v.(type) {
+				case bool, int, int64, uint, uint64, string, float64, time.Time:
+				case map[string]interface{}:
+					if err := validateFieldQuery(&t); err != nil {
+						return err
+					}
+				default:
+					return errors.New("JSON structured data key with unrecognised value type")
+				}
+				sdClauses = append(sdClauses, clause)
+			} else if ak, ok := attributeQueryKey(k); ok {
+				switch t := v.(type) {
+				case bool, int, int64, uint, uint64, string, float64, time.Time:
+				case map[string]interface{}:
+					if err := validateFieldQuery(&t); err != nil {
+						return err
+					}
+				default:
+					return errors.New("JSON attribute key with unrecognised value type")
+				}
+				nm[ak] = v
+			} else if jk, ok := jsonMap[k]; ok && !hasFieldProperty(jk, fpNoQuery) {
 				// The value must either be:
 				// 0. a straight value
 				// 1. a map containing a single element of a relational operator and a value
@@ -166,6 +283,14 @@ func jsonToDbKeys(i *interface{}) error {
 				return errors.New("Bad JSON key")
 			}
 		}
+		switch len(sdClauses) {
+		case 0:
+		case 1:
+			nm["structureddata"] = sdClauses[0]
+		default:
+			// Each must match some element
+			nm["structureddata"] = map[string]interface{}{"$all": sdClauses}
+		}
 		*i = nm
 	} else {
 		return errors.New("JSON primary query must be a map")
@@ -207,13 +332,14 @@ func wrapAsHandler(inner ContextHandlerFunc, c *Context) http.HandlerFunc {
 	}
 }
 
-func newRouter(db *Database) *mux.Router {
+func newRouter(db *Database, listener string) *mux.Router {
 
 	router := mux.NewRouter().StrictSlash(true)
 	for _, route := range routes {
 		context := &Context{
 			route,
 			db,
+			listener,
 		}
 		router.
 			Methods(route.Method).
@@ -226,7 +352,7 @@ func newRouter(db *Database) *mux.Router {
 
 func createLogItem(c *Context, w http.ResponseWriter, r *http.Request) {
 	var logItem LogItem
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1*1024*1024))
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLogItemLen))
 	if err != nil {
 		panic(err)
 	}
@@ -237,30 +363,186 @@ func createLogItem(c *Context, w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Cannot parse JSON", 422)
 		return
 	}
-	logItem.OriginatorIp = ""
-	logItem.OriginatorPort = 0
+	logItem.setRequestOrigin(r)
+	logItem.normalise()
+	logItem.assignShardGroup(c.listener)
+	logItem.makeHashAndInsert(c.db)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusCreated)
+	var reply interface{} = logItem
+	if receipt, _ := strconv.ParseBool(r.URL.Query().Get("receipt")); receipt {
+		// The item cannot yet be in a tree head, so return a receipt which can
+		// be redeemed for an inclusion proof once it is
+		reply = struct {
+			*LogItem
+			Receipt *Receipt `json:"receipt"`
+		}{&logItem, logItem.receipt()}
+	}
+	if err := json.NewEncoder(w).Encode(reply); err != nil {
+		panic(err)
+	}
+}
+
+const (
+	maxLogItemLen = 1 * 1024 * 1024
+	maxBulkLen    = 64 * 1024 * 1024
+)
+
+type bulkResult struct {
+	Line       int    `json:"line"`
+	Status     int    `json:"status"`
+	ShardGroup int    `json:"shard_group,omitempty"`
+	SequenceId int64  `json:"sequence_id,omitempty"`
+	Hash       string `json:"hash,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+/*
+ * Create log items from newline delimited JSON, one item per line, as for
+ * /logitem/create. The body may be gzipped (Content-Encoding: gzip). Items
+ * are chained in order (within each shard group), and the reply gives for
+ * each non-blank line its status as for /logitem/create (201 chained, 422
+ * unparseable) with the sequence_id and hash of chained items. If chaining
+ * fails partway the lines not chained have status 500.
+ */
+func bulkCreateLogItem(c *Context, w http.ResponseWriter, r *http.Request) {
+	body, err := readRequestBody(r, maxBulkLen)
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), 422)
+		return
+	}
+
+	results, items, itemResults := parseBulkLogItems(r, body, c.listener)
+	chainBulkLogItems(items, itemResults, func(batch []*LogItem) {
+		insertLogItems(c.db, batch)
+	})
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"results": results}); err != nil {
+		panic(err)
+	}
+}
+
+// Parse each line of a bulk request, returning the results for every
+// non-blank line, and the items parsed together with their results
+func parseBulkLogItems(r *http.Request, body []byte, listener string) ([]*bulkResult, []*LogItem, []*bulkResult) {
+	var results []*bulkResult
+	var items []*LogItem
+	var itemResults []*bulkResult
+	for i, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		result := &bulkResult{Line: i + 1}
+		results = append(results, result)
+		if len(line) > maxLogItemLen {
+			result.Status = 422
+			result.Error = "Line too long"
+			continue
+		}
+		logItem := &LogItem{}
+		if err := json.Unmarshal(line, logItem); err != nil {
+			result.Status = 422
+			result.Error = "Cannot parse JSON"
+			continue
+		}
+		logItem.setRequestOrigin(r)
+		logItem.normalise()
+		logItem.assignShardGroup(listener)
+		items = append(items, logItem)
+		itemResults = append(itemResults, result)
+	}
+	return results, items, itemResults
+}
+
+// Chain items in batches with insert, stopping at the first failure, and
+// fill in their results
+func chainBulkLogItems(items []*LogItem, results []*bulkResult, insert func([]*LogItem)) {
+	step := ingestBatchSize
+	if step < 1 {
+		step = 1
+	}
+	failed := false
+	for start := 0; start < len(items) && !failed; start += step {
+		end := start + step
+		if end > len(items) {
+			end = len(items)
+		}
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("panic caught: %+v", err)
+					failed = true
+				}
+			}()
+			insert(items[start:end])
+		}()
+		for i := start; i < end; i++ {
+			l, result := items[i], results[i]
+			switch {
+			case l.Verified:
+				result.Status = http.StatusCreated
+				result.ShardGroup = l.ShardGroup
+				result.SequenceId = l.SequenceId
+				result.Hash = l.Hash
+			default:
+				result.Status = 500
+				result.Error = "Cannot chain item"
+			}
+		}
+	}
+	for _, result := range results {
+		if result.Status == 0 {
+			result.Status = 500
+			result.Error = "Cannot chain item"
+		}
+	}
+}
+
+// Set the originator and client name of an item from the request which
+// carried it
+func (l *LogItem) setRequestOrigin(r *http.Request) {
+	l.OriginatorIp = ""
+	l.OriginatorPort = 0
 	if ip, po, err := net.SplitHostPort(r.RemoteAddr); err == nil {
-		logItem.OriginatorIp = ip
+		l.OriginatorIp = ip
 		if p, err := strconv.Atoi(po); err == nil {
-			logItem.OriginatorPort = p
+			l.OriginatorPort = p
 		}
 	}
 
 	if tls := r.TLS; tls != nil {
 		certs := tls.PeerCertificates
 		if len(certs) > 0 {
-			logItem.ClientName = certs[0].Subject.CommonName
+			l.ClientName = certs[0].Subject.CommonName
 		}
 	}
+}
 
-	logItem.normalise()
-	logItem.makeHashAndInsert(c.db)
-
-	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-	w.WriteHeader(http.StatusCreated)
-	if err := json.NewEncoder(w).Encode(logItem); err != nil {
-		panic(err)
+// Read a request body of at most max bytes, gunzipping it if need be
+func readRequestBody(r *http.Request, max int) ([]byte, error) {
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		body = gz
 	}
+	b, err := ioutil.ReadAll(io.LimitReader(body, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > max {
+		return nil, errors.New("Request too large")
+	}
+	return b, nil
 }
 
 func queryLogItem(c *Context, w http.ResponseWriter, r *http.Request) {
@@ -317,6 +599,27 @@ func queryLogItem(c *Context, w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	// A period restricts the query to the shard ranges the shard index
+	// says were chained during it
+	since, ok := getQueryTime(r, "since")
+	if !ok {
+		http.Error(w, "Cannot parse since", 422)
+		return
+	}
+	until, ok := getQueryTime(r, "until")
+	if !ok {
+		http.Error(w, "Cannot parse until", 422)
+		return
+	}
+	var ranges []*shardRange
+	if !since.IsZero() || !until.IsZero() {
+		func() {
+			sessionCopy := c.db.mongoSession.Copy()
+			defer sessionCopy.Close()
+			ranges = shardRangesBetween(c.db, sessionCopy, since, until)
+		}()
+	}
+
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(http.StatusFound)
 	w.Write([]byte("{\"results\":[\n"))
@@ -343,20 +646,234 @@ func queryLogItem(c *Context, w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}()
-	count, complete := queryLogItems(c.db, query, sortOrder, limit, ch)
+	status := queryLogItems(c.db, query, sortOrder, limit, ranges, ch)
 	close(ch)
 	wait.Wait()
-	w.Write([]byte(fmt.Sprintf("],\"complete\":%t,\"count\":%d}\n", complete, count)))
+	shards, err := json.Marshal(status.Shards)
+	if err != nil {
+		panic(err)
+	}
+	w.Write([]byte(fmt.Sprintf("],\"complete\":%t,\"count\":%d,\"truncated\":%t,\"shards\":%s}\n", status.Complete, status.Count, status.Truncated, shards)))
+}
+
+// Parse an integer query parameter, returning def if it is absent
+func getQueryInt(r *http.Request, key string, def int64) (int64, bool) {
+	str := r.URL.Query().Get(key)
+	if len(str) == 0 {
+		return def, true
+	}
+	v, err := strconv.ParseInt(str, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v, true
+}
+
+// Parse an RFC 3339 time query parameter, returning the zero time if it is
+// absent
+func getQueryTime(r *http.Request, key string) (time.Time, bool) {
+	str := r.URL.Query().Get(key)
+	if len(str) == 0 {
+		return time.Time{}, true
+	}
+	t, err := time.Parse(time.RFC3339, str)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+func verifyLogItem(c *Context, w http.ResponseWriter, r *http.Request) {
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+
+	shardGroup, ok := getQueryInt(r, "shard_group", -1)
+	if !ok || shardGroup < 0 {
+		http.Error(w, "Cannot parse shard_group", 422)
+		return
+	}
+	from, ok := getQueryInt(r, "from", 0)
+	if !ok || from < 0 {
+		http.Error(w, "Cannot parse from", 422)
+		return
+	}
+	to, ok := getQueryInt(r, "to", -1)
+	if !ok || (to >= 0 && to < from) {
+		http.Error(w, "Cannot parse to", 422)
+		return
+	}
+
+	report := verifyChain(c.db, int(shardGroup), from, to)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		panic(err)
+	}
+}
+
+func proofLogItem(c *Context, w http.ResponseWriter, r *http.Request) {
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+
+	shardGroup, ok := getQueryInt(r, "shard_group", -1)
+	if !ok || shardGroup < 0 {
+		http.Error(w, "Cannot parse shard_group", 422)
+		return
+	}
+	sequenceId, ok := getQueryInt(r, "sequence_id", -1)
+	if !ok || sequenceId < 0 {
+		http.Error(w, "Cannot parse sequence_id", 422)
+		return
+	}
+	treeSize, ok := getQueryInt(r, "tree_size", -1)
+	if !ok {
+		http.Error(w, "Cannot parse tree_size", 422)
+		return
+	}
+
+	proof, err := merkleInclusionProof(c.db, int(shardGroup), sequenceId, treeSize)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(proof); err != nil {
+		panic(err)
+	}
+}
+
+func consistencyLogItem(c *Context, w http.ResponseWriter, r *http.Request) {
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+
+	shardGroup, ok := getQueryInt(r, "shard_group", -1)
+	if !ok || shardGroup < 0 {
+		http.Error(w, "Cannot parse shard_group", 422)
+		return
+	}
+	first, ok := getQueryInt(r, "first", -1)
+	if !ok || first < 0 {
+		http.Error(w, "Cannot parse first", 422)
+		return
+	}
+	second, ok := getQueryInt(r, "second", -1)
+	if !ok {
+		http.Error(w, "Cannot parse second", 422)
+		return
+	}
+
+	proof, err := merkleConsistencyProof(c.db, int(shardGroup), first, second)
+	switch err {
+	case nil:
+	case errBadTreeSizes:
+		http.Error(w, err.Error(), 422)
+		return
+	default:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(proof); err != nil {
+		panic(err)
+	}
+}
+
+func shardIndex(c *Context, w http.ResponseWriter, r *http.Request) {
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+
+	since, ok := getQueryTime(r, "since")
+	if !ok {
+		http.Error(w, "Cannot parse since", 422)
+		return
+	}
+	until, ok := getQueryTime(r, "until")
+	if !ok || (!until.IsZero() && until.Before(since)) {
+		http.Error(w, "Cannot parse until", 422)
+		return
+	}
+
+	report := queryShardIndex(c.db, since, until)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		panic(err)
+	}
+}
+
+func queryCheckpoint(c *Context, w http.ResponseWriter, r *http.Request) {
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+
+	shardGroup, ok := getQueryInt(r, "shard_group", -1)
+	if !ok {
+		http.Error(w, "Cannot parse shard_group", 422)
+		return
+	}
+	limit, ok := getQueryInt(r, "limit", 100)
+	if !ok {
+		http.Error(w, "Cannot parse limit", 422)
+		return
+	}
+
+	checkpoints := queryCheckpoints(c.db, int(shardGroup), int(limit))
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"checkpoints": checkpoints}); err != nil {
+		panic(err)
+	}
+}
+
+func checkpointPublicKey(c *Context, w http.ResponseWriter, r *http.Request) {
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+	if checkpointSigner == nil {
+		http.Error(w, "Checkpoints are not being signed", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.WriteHeader(http.StatusOK)
+	w.Write(checkpointPublicKeyPEM)
+}
+
+// Only the scanner's metrics: expvar's own handler would also give away the
+// command line and memory statistics
+func metrics(c *Context, w http.ResponseWriter, r *http.Request) {
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+	values := make(map[string]int64)
+	for name, v := range scannerMetrics {
+		values[name] = v.Value()
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(values); err != nil {
+		panic(err)
+	}
 }
 
 func httpServerStart(db *Database, listen string) {
-	router := newRouter(db)
+	router := newRouter(db, listen)
 	log.Fatal(http.ListenAndServe(listen, router))
 }
 
 func httpsServerStart(db *Database, listen string, tlsConfig *tls.Config) {
 	// This is somewhat hacky - see tlshackery.go for why
-	router := newRouter(db)
+	router := newRouter(db, listen)
 	server := &http.Server{
 		Addr:      listen,
 		TLSConfig: tlsConfig,
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func httpTestGzip(b []byte) []byte {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	w.Write(b)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestParseBulkLogItems(t *testing.T) {
+	initFieldProperties()
+	long := `{"message":"` + strings.Repeat("x", maxLogItemLen) + `"}`
+	body := strings.Join([]string{
+		`{"message":"a","level":"warn"}`,
+		``,
+		"  \t",
+		`not json`,
+		`{"message":"b"}` + "\r",
+		long,
+		`[1]`,
+		`{"message":"c"`,
+		`  {"message":"d"}  `,
+		``,
+	}, "\n")
+	r := httptest.NewRequest("POST", "/logitem/bulk", nil)
+	results, items, itemResults := parseBulkLogItems(r, []byte(body), "")
+
+	var lines, statuses []int
+	for _, result := range results {
+		lines = append(lines, result.Line)
+		statuses = append(statuses, result.Status)
+	}
+	if want := []int{1, 4, 5, 6, 7, 8, 9}; !reflect.DeepEqual(lines, want) {
+		t.Errorf("lines %v, want %v", lines, want)
+	}
+	if want := []int{0, 422, 0, 422, 422, 422, 0}; !reflect.DeepEqual(statuses, want) {
+		t.Errorf("statuses %v, want %v", statuses, want)
+	}
+	if results[3].Error != "Line too long" || results[1].Error != "Cannot parse JSON" {
+		t.Errorf("errors %q and %q", results[3].Error, results[1].Error)
+	}
+
+	if len(items) != 3 || len(itemResults) != 3 {
+		t.Fatalf("%d items with %d results", len(items), len(itemResults))
+	}
+	for i, want := range []struct {
+		message string
+		line    int
+	}{{"a", 1}, {"b", 5}, {"d", 9}} {
+		l := items[i]
+		if l.Message != want.message || itemResults[i] != results[[]int{0, 2, 6}[i]] || itemResults[i].Line != want.line {
+			t.Errorf("item %d: got %q for line %d", i, l.Message, itemResults[i].Line)
+		}
+		if l.OriginatorIp != "192.0.2.1" || l.OriginatorPort != 1234 || l.Time.IsZero() || l.ShardGroup != defaultShardGroup {
+			t.Errorf("item %d: got %+v", i, l)
+		}
+	}
+	if items[0].LevelNo != levelMap["warn"] {
+		t.Errorf("level_no %d", items[0].LevelNo)
+	}
+}
+
+func TestChainBulkLogItems(t *testing.T) {
+	saved := ingestBatchSize
+	t.Cleanup(func() { ingestBatchSize = saved })
+	for _, tc := range []struct {
+		name      string
+		items     int
+		batchSize int
+		failAt    int // The item whose insert fails, or -1
+		inserts   int
+		statuses  []int
+	}{
+		{"all chained", 5, 2, -1, 3, []int{201, 201, 201, 201, 201}},
+		{"one batch", 3, 10, -1, 1, []int{201, 201, 201}},
+		{"no batch size", 3, 0, -1, 3, []int{201, 201, 201}},
+		{"failure partway through a batch", 5, 2, 3, 2, []int{201, 201, 201, 500, 500}},
+		{"failure at the start of a batch", 5, 2, 2, 2, []int{201, 201, 500, 500, 500}},
+		{"failure at the first item", 4, 10, 0, 1, []int{500, 500, 500, 500}},
+		{"failure at the last item", 4, 1, 3, 4, []int{201, 201, 201, 500}},
+		{"nothing to chain", 0, 2, -1, 0, nil},
+	} {
+		ingestBatchSize = tc.batchSize
+		items := make([]*LogItem, tc.items)
+		results := make([]*bulkResult, tc.items)
+		for i := range items {
+			items[i] = &LogItem{Message: fmt.Sprint(i), ShardGroup: 3}
+			results[i] = &bulkResult{Line: i + 1}
+		}
+		inserts := 0
+		chainBulkLogItems(items, results, func(batch []*LogItem) {
+			inserts++
+			// Chain each item in turn, as the sequencer does, until the
+			// failing one
+			for _, l := range batch {
+				if l.Message == fmt.Sprint(tc.failAt) {
+					panic("insert failed")
+				}
+				l.SequenceId = 101
+				l.Hash = "h" + l.Message
+				l.Verified = true
+			}
+		})
+		var statuses []int
+		for i, result := range results {
+			statuses = append(statuses, result.Status)
+			switch result.Status {
+			case 201:
+				if result.ShardGroup != 3 || result.SequenceId != 101 || result.Hash != "h"+items[i].Message || result.Error != "" {
+					t.Errorf("%s: result %+v", tc.name, result)
+				}
+			case 500:
+				if result.Error != "Cannot chain item" || result.Hash != "" {
+					t.Errorf("%s: result %+v", tc.name, result)
+				}
+			}
+		}
+		if inserts != tc.inserts || !reflect.DeepEqual(statuses, tc.statuses) {
+			t.Errorf("%s: %d inserts with statuses %v, want %d with %v", tc.name, inserts, statuses, tc.inserts, tc.statuses)
+		}
+	}
+}
+
+func TestReadRequestBody(t *testing.T) {
+	data := []byte(`{"message":"hello"}`)
+	for _, tc := range []struct {
+		name string
+		body []byte
+		gzip bool
+		max  int
+		ok   bool
+	}{
+		{"plain", data, false, 100, true},
+		{"gzip", httpTestGzip(data), true, 100, true},
+		{"plain at the limit", data, false, len(data), true},
+		{"gzip at the limit", httpTestGzip(data), true, len(data), true},
+		{"plain too large", data, false, len(data) - 1, false},
+		{"gzip too large", httpTestGzip(data), true, len(data) - 1, false},
+		{"gzip expanding far too large", httpTestGzip(make([]byte, 1<<20)), true, 100, false},
+		{"gzip not gzipped", data, true, 100, false},
+		{"gzip truncated", httpTestGzip(data)[:20], true, 100, false},
+		{"gzipped without the header", httpTestGzip(data), false, 100, true},
+	} {
+		r := httptest.NewRequest("POST", "/logitem/bulk", bytes.NewReader(tc.body))
+		if tc.gzip {
+			r.Header.Set("Content-Encoding", "gzip")
+		}
+		got, err := readRequestBody(r, tc.max)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: error %v", tc.name, err)
+			continue
+		}
+		if tc.ok && tc.gzip && !bytes.Equal(got, data) {
+			t.Errorf("%s: got %q", tc.name, got)
+		}
+	}
+}
+
+// Requests with nothing to chain need no database
+func TestBulkCreateLogItem(t *testing.T) {
+	initFieldProperties()
+	for _, tc := range []struct {
+		name   string
+		body   []byte
+		gzip   bool
+		status int
+		reply  string
+	}{
+		{"unparseable lines", []byte("not json\n\n{bad\n"), false, http.StatusOK,
+			`{"results":[{"line":1,"status":422,"error":"Cannot parse JSON"},{"line":3,"status":422,"error":"Cannot parse JSON"}]}`},
+		{"gzipped", httpTestGzip([]byte("\n\nnot json")), true, http.StatusOK,
+			`{"results":[{"line":3,"status":422,"error":"Cannot parse JSON"}]}`},
+		{"empty", nil, false, http.StatusOK, ""},
+		{"bad gzip", []byte("not json"), true, 422, ""},
+	} {
+		r := httptest.NewRequest("POST", "/logitem/bulk", bytes.NewReader(tc.body))
+		if tc.gzip {
+			r.Header.Set("Content-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		bulkCreateLogItem(&Context{}, w, r)
+		if w.Code != tc.status || (tc.reply != "" && strings.TrimSpace(w.Body.String()) != tc.reply) {
+			t.Errorf("%s: got %d %s", tc.name, w.Code, w.Body.String())
+		}
+	}
+}
+
+// Only the scanner's metrics are served
+func TestMetrics(t *testing.T) {
+	tamperAlerts.Add(1)
+	w := httptest.NewRecorder()
+	metrics(&Context{}, w, httptest.NewRequest("GET", "/debug/vars", nil))
+	var got map[string]int64
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("bad reply %s", w.Body.String())
+	}
+	want := map[string]int64{
+		"scanner_items_verified": scannedItems.Value(),
+		"scanner_passes":         scannedPasses.Value(),
+		"tamper_alerts":          tamperAlerts.Value(),
+	}
+	if w.Code != http.StatusOK || !reflect.DeepEqual(got, want) || got["tamper_alerts"] < 1 {
+		t.Errorf("got %d %s", w.Code, w.Body.String())
+	}
+}
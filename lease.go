@@ -0,0 +1,350 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ * Several instances may share a database. Each shard group is written by
+ * whichever instance holds its lease, a document in the lease collection
+ * recording the owner and when the lease expires. The owner renews its
+ * leases every third of the lease duration; once a lease expires any other
+ * instance may take it over.
+ *
+ * Instances not holding a shard group's lease queue its items in the
+ * pending collection, and the owner drains them into the chain, marking
+ * each queued item chained with its place in the chain. The instance which
+ * queued them waits for that before replying to the sender, so an item is
+ * never acknowledged before it is chained.
+ *
+ * The owner first claims each queued item, and records its pending id on
+ * the item it chains. If the owner has not claimed them within
+ * pendingTimeout, the waiting instance withdraws those still unclaimed and
+ * refuses the request so the sender retries; it keeps waiting for those
+ * claimed, which will be chained. Should an owner fail having chained
+ * items but before marking them chained, the next owner finds them in the
+ * chain by their pending ids rather than chaining them again. Chained
+ * entries are removed by the waiting instance, or expire after
+ * pendingExpiry should it have gone away.
+ *
+ * Leases only avoid instances fighting over a chain: the unique index on
+ * sequence ids still ensures two writers can never fork it.
+ */
+
+var (
+	leaseDuration   = 30 // Seconds
+	leaseCollName   = "leases"
+	pendingCollName = "pending"
+	instanceId      string
+)
+
+// The lease id for work spanning every shard group
+const shardIndexLease = -1
+
+type lease struct {
+	ShardGroup int `bson:"_id"`
+	Owner      string
+	Expires    time.Time
+}
+
+type pendingItem struct {
+	Id        bson.ObjectId `bson:"_id"`
+	LogItem   `bson:",inline"`
+	ClaimedBy string    `bson:",omitempty"` // The owner which has claimed it to chain
+	ClaimedAt time.Time `bson:",omitempty"`
+	ChainedAt time.Time `bson:",omitempty"` // Zero until the owner has chained it
+}
+
+const (
+	pendingPollInterval = 250 * time.Millisecond
+	pendingExpiry       = time.Hour
+)
+
+// How long to wait for the owner of a shard group to chain queued items:
+// long enough for a dead owner's lease to expire and another to take over
+func pendingTimeout() time.Duration {
+	return 3 * time.Duration(leaseDuration) * time.Second
+}
+
+var (
+	leaseMutex sync.Mutex
+	leases     = make(map[int]time.Time) // When each lease we hold expires
+	leaseTried = make(map[int]time.Time) // When we last tried for leases we do not hold
+)
+
+func (db *Database) getLeaseCollection(s *mgo.Session) *mgo.Collection {
+	return s.DB(databaseName).C(leaseCollName)
+}
+
+func (db *Database) getPendingCollection(s *mgo.Session) *mgo.Collection {
+	return s.DB(databaseName).C(pendingCollName)
+}
+
+func leaseRenewInterval() time.Duration {
+	return time.Duration(leaseDuration) * time.Second / 3
+}
+
+// Take or renew a lease, returning whether we hold it
+func acquireLease(db *Database, s *mgo.Session, shardGroup int) bool {
+	now := time.Now()
+	expires := now.Add(time.Duration(leaseDuration) * time.Second)
+	c := db.getLeaseCollection(s)
+	err := c.Update(bson.M{
+		"_id": shardGroup,
+		"$or": []bson.M{{"owner": instanceId}, {"expires": bson.M{"$lt": now}}},
+	}, bson.M{"$set": bson.M{"owner": instanceId, "expires": expires}})
+	if err == mgo.ErrNotFound {
+		err = c.Insert(&lease{ShardGroup: shardGroup, Owner: instanceId, Expires: expires})
+	}
+
+	leaseMutex.Lock()
+	defer leaseMutex.Unlock()
+	_, held := leases[shardGroup]
+	if err != nil {
+		if !mgo.IsDup(err) {
+			log.Panicf("Cannot acquire lease %v\n", err)
+		}
+		// Someone else holds it
+		if held {
+			log.Printf("Lost lease on shard group %d\n", shardGroup)
+			delete(leases, shardGroup)
+		}
+		return false
+	}
+	if !held {
+		log.Printf("Acquired lease on shard group %d\n", shardGroup)
+	}
+	leases[shardGroup] = expires
+	return true
+}
+
+// Whether we may write a shard group, trying for its lease if we do not
+// hold it and have not tried recently
+func holdsLease(db *Database, s *mgo.Session, shardGroup int) bool {
+	now := time.Now()
+	leaseMutex.Lock()
+	expires, held := leases[shardGroup]
+	tried := leaseTried[shardGroup]
+	if !held && now.Sub(tried) >= leaseRenewInterval() {
+		leaseTried[shardGroup] = now
+	}
+	leaseMutex.Unlock()
+
+	// Stop writing well before anyone else could take over
+	if held && now.Add(leaseRenewInterval()).Before(expires) {
+		return true
+	}
+	if !held && now.Sub(tried) < leaseRenewInterval() {
+		return false
+	}
+	return acquireLease(db, s, shardGroup)
+}
+
+// Queue items for the owner of their shard group to chain, returning the
+// ids to wait for them by
+func queuePending(db *Database, s *mgo.Session, items []*LogItem) []bson.ObjectId {
+	ids := make([]bson.ObjectId, len(items))
+	docs := make([]interface{}, len(items))
+	for i, l := range items {
+		ids[i] = bson.NewObjectId()
+		docs[i] = &pendingItem{Id: ids[i], LogItem: *l}
+	}
+	if err := db.getPendingCollection(s).Insert(docs...); err != nil {
+		log.Panicf("Could not queue pending items %v\n", err)
+	}
+	return ids
+}
+
+// Wait for the owner of the items' shard group to chain the items we queued
+// for it, copying back their places in the chain. Panics if it does not
+// claim them in time, having withdrawn those not yet claimed.
+func waitPending(db *Database, items []*LogItem, ids []bson.ObjectId) {
+	sessionCopy := db.mongoSession.Copy()
+	defer sessionCopy.Close()
+	c := db.getPendingCollection(sessionCopy)
+
+	waiting := make(map[bson.ObjectId]*LogItem)
+	for i, id := range ids {
+		waiting[id] = items[i]
+	}
+	deadline := time.Now().Add(pendingTimeout())
+	withdrawn := false
+	for {
+		remaining := make([]bson.ObjectId, 0, len(waiting))
+		for id := range waiting {
+			remaining = append(remaining, id)
+		}
+		var chained []pendingItem
+		if err := c.Find(bson.M{"_id": bson.M{"$in": remaining}, "chainedat": bson.M{"$exists": true}}).All(&chained); err != nil {
+			log.Panicf("Query returned error %v\n", err)
+		}
+		if len(chained) > 0 {
+			done := make([]bson.ObjectId, len(chained))
+			for i := range chained {
+				l := waiting[chained[i].Id]
+				*l = chained[i].LogItem
+				l.Verified = true
+				delete(waiting, chained[i].Id)
+				done[i] = chained[i].Id
+			}
+			if _, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": done}}); err != nil {
+				log.Panicf("Could not remove pending items %v\n", err)
+			}
+		}
+		if len(waiting) == 0 {
+			return
+		}
+		if withdrawn {
+			// Any left are either claimed, or were withdrawn
+			claimed, err := c.Find(bson.M{"_id": bson.M{"$in": remaining}, "chainedat": bson.M{"$exists": false}}).Count()
+			if err != nil {
+				log.Panicf("Query returned error %v\n", err)
+			}
+			if claimed == 0 {
+				log.Panicf("Timed out waiting for %d queued items to be chained\n", len(waiting))
+			}
+		}
+		if !withdrawn && time.Now().After(deadline) {
+			// Withdraw those the owner has not claimed. It will chain those
+			// it has, so keep waiting for them.
+			if _, err := c.RemoveAll(bson.M{"_id": bson.M{"$in": remaining}, "claimedby": bson.M{"$exists": false}}); err != nil {
+				log.Panicf("Could not remove pending items %v\n", err)
+			}
+			withdrawn = true
+			continue
+		}
+		time.Sleep(pendingPollInterval)
+	}
+}
+
+// Chain the items queued for a shard group by other instances, stopping
+// at a deadline so we get back to renewing leases
+func drainPending(db *Database, s *mgo.Session, shardGroup int, deadline time.Time) {
+	c := db.getPendingCollection(s)
+	for time.Now().Before(deadline) {
+		var pending []pendingItem
+		if err := c.Find(bson.M{"shardgroup": shardGroup, "chainedat": bson.M{"$exists": false}}).Select(bson.M{"_id": 1}).Sort("_id").Limit(ingestBatchSize).All(&pending); err != nil {
+			log.Panicf("Query returned error %v\n", err)
+		}
+		if len(pending) == 0 {
+			return
+		}
+		ids := make([]bson.ObjectId, len(pending))
+		for i := range pending {
+			ids[i] = pending[i].Id
+		}
+
+		// Claim them, each atomically, so they can no longer be withdrawn.
+		// Those withdrawn before we could are gone.
+		if _, err := c.UpdateAll(bson.M{"_id": bson.M{"$in": ids}, "chainedat": bson.M{"$exists": false}},
+			bson.M{"$set": bson.M{"claimedby": instanceId, "claimedat": time.Now()}}); err != nil {
+			log.Panicf("Could not claim pending items %v\n", err)
+		}
+		pending = nil
+		if err := c.Find(bson.M{"_id": bson.M{"$in": ids}, "claimedby": instanceId, "chainedat": bson.M{"$exists": false}}).Sort("_id").All(&pending); err != nil {
+			log.Panicf("Query returned error %v\n", err)
+		}
+
+		// A previous owner may have chained some without marking them so
+		var already []LogItem
+		if err := db.getLogItemCollection(s).Find(bson.M{"pendingid": bson.M{"$in": ids}}).All(&already); err != nil {
+			log.Panicf("Query returned error %v\n", err)
+		}
+		chained := make(map[bson.ObjectId]LogItem)
+		for _, l := range already {
+			chained[l.PendingId] = l
+		}
+		var items []*LogItem
+		for i := range pending {
+			if l, ok := chained[pending[i].Id]; ok {
+				pending[i].LogItem = l
+				continue
+			}
+			pending[i].PendingId = pending[i].Id
+			items = append(items, &pending[i].LogItem)
+		}
+		if len(items) > 0 {
+			sequenceLogItems(db, items, true)
+		}
+
+		now := time.Now()
+		for i := range pending {
+			pending[i].ChainedAt = now
+			if err := c.UpdateId(pending[i].Id, &pending[i]); err != nil {
+				log.Panicf("Could not mark pending item chained %v\n", err)
+			}
+		}
+	}
+}
+
+// Every shard group we might need the lease of
+func leaseCandidates(db *Database, s *mgo.Session) []int {
+	candidates := make(map[int]bool)
+	for _, sg := range db.shardGroups(s) {
+		candidates[sg] = true
+	}
+	var pending []int
+	if err := db.getPendingCollection(s).Find(bson.M{"chainedat": bson.M{"$exists": false}}).Distinct("shardgroup", &pending); err != nil {
+		log.Panicf("Query returned error %v\n", err)
+	}
+	for _, sg := range pending {
+		candidates[sg] = true
+	}
+	leaseMutex.Lock()
+	for sg := range leases {
+		candidates[sg] = true
+	}
+	leaseMutex.Unlock()
+	if shardIndexInterval > 0 {
+		candidates[shardIndexLease] = true
+	}
+
+	result := make([]int, 0, len(candidates))
+	for sg := range candidates {
+		result = append(result, sg)
+	}
+	return result
+}
+
+func leaseRun(db *Database) {
+	for {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("panic caught in lease thread: %+v", err)
+				}
+			}()
+			sessionCopy := db.mongoSession.Copy()
+			defer sessionCopy.Close()
+			deadline := time.Now().Add(leaseRenewInterval() / 2)
+			for _, sg := range leaseCandidates(db, sessionCopy) {
+				if acquireLease(db, sessionCopy, sg) && sg != shardIndexLease {
+					drainPending(db, sessionCopy, sg, deadline)
+				}
+			}
+		}()
+		time.Sleep(leaseRenewInterval())
+	}
+}
+
+func startLeases(db *Database) {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		log.Fatalf("Cannot generate instance id: %v", err)
+	}
+	instanceId = fmt.Sprintf("%s-%d-%s", host, os.Getpid(), hex.EncodeToString(b))
+	log.Printf("Starting as instance %s with %d second leases\n", instanceId, leaseDuration)
+	go leaseRun(db)
+}
@@ -2,14 +2,14 @@ package main
 
 import (
 	"bytes"
+	"crypto/hmac"
 	"crypto/sha256"
 	"crypto/subtle"
+	"errors"
 	"fmt"
 	"github.com/fatih/structs"
-	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 	"log"
-	"math/rand"
 	"sort"
 	"strings"
 	"time"
@@ -32,6 +32,13 @@ import (
  *
  *   // Parsed by us
  *   levelno: 3
+ *
+ *   // From RFC 5424 syslog
+ *   app_name: "appname", proc_id: "1234", msg_id: "ID47",
+ *   structured_data: [ { id: "origin", params: [ { name: "ip", value: "192.0.2.1" } ] } ]
+ *
+ *   // From OpenTelemetry logs
+ *   trace_id: "5b8efff798038103d269b633813fc60c", span_id: "eee19b7ec3c1b174"
  *  }
  */
 type LogItem struct {
@@ -60,7 +67,24 @@ type LogItem struct {
 	ShardGroup    int    `json:"shard_group"`
 	FormatVersion int    `json:"format_version"`
 	ClientName    string `json:"client_name" bson:",omitempty"`
+	KeyId         string `json:"key_id" bson:",omitempty" slogger:"nolegacy"`
 	Verified      bool   `json:"verified" bson:",omitempty" slogger:"nohash,noquery,noindex"`
+
+	// Set if queued for the owner of the shard group to chain (see lease.go)
+	PendingId bson.ObjectId `json:"-" bson:",omitempty" slogger:"nohash,nolegacy,noquery"`
+
+	// From RFC 5424 syslog messages (see structureddata.go)
+	AppName        string      `json:"app_name" bson:",omitempty" slogger:"nolegacy"`
+	ProcId         string      `json:"proc_id" bson:",omitempty" slogger:"nolegacy"`
+	MsgId          string      `json:"msg_id" bson:",omitempty" slogger:"nolegacy"`
+	StructuredData []SDElement `json:"structured_data" bson:",omitempty" slogger:"nolegacy,noquery,noindex"`
+
+	// From OpenTelemetry logs (see otlp.go), as lower case hex
+	TraceId string `json:"trace_id" bson:",omitempty" slogger:"nolegacy"`
+	SpanId  string `json:"span_id" bson:",omitempty" slogger:"nolegacy,noindex"`
+
+	// Extra fields from other inputs (see attributes.go)
+	Attributes map[string]string `json:"attributes" bson:",omitempty" slogger:"nolegacy,noquery,noindex"`
 }
 
 type LogItems []LogItem
@@ -124,22 +148,25 @@ const (
 	initialBackoff          = 1          // Initial backoff period in microseconds
 	maximumBackoff          = 100 * 1000 // Maximum backoff period in microseconds
 	iterationsBeforeBackoff = 5
-	shardGroup              = 1234
 )
 
 var (
-	hashSecret string
+	formatVersion = 1 // The format version used for new items
 )
 
+const maxFormatVersion = 3
+
 const (
-	fpPresent = iota
-	fpNoHash  = iota
-	fpNoQuery = iota
-	fpNoIndex = iota
+	fpPresent  = iota
+	fpNoHash   = iota
+	fpNoQuery  = iota
+	fpNoIndex  = iota
+	fpNoLegacy = iota
 )
 
 type fieldType struct {
 	name       string
+	jsonName   string
 	properties map[int]interface{}
 }
 
@@ -169,8 +196,12 @@ func initFieldProperties() {
 	for _, f := range structs.Fields(&LogItem{}) {
 		if f.IsExported() {
 			name := f.Name()
+			jname := name
+			if tag := f.Tag("json"); tag != "" {
+				jname = strings.Split(tag, ",")[0]
+			}
 			logItemFieldList = append(logItemFieldList, name)
-			logItemFields[strings.ToLower(name)] = fieldType{name: name, properties: make(map[int]interface{})}
+			logItemFields[strings.ToLower(name)] = fieldType{name: name, jsonName: jname, properties: make(map[int]interface{})}
 			setFieldProperty(name, fpPresent, true)
 			if tag := f.Tag("slogger"); tag != "" {
 				comps := strings.Split(tag, ",")
@@ -182,12 +213,15 @@ func initFieldProperties() {
 						setFieldProperty(name, fpNoQuery, true)
 					case "noindex":
 						setFieldProperty(name, fpNoIndex, true)
+					case "nolegacy":
+						setFieldProperty(name, fpNoLegacy, true)
 					}
 				}
 			}
 		}
 	}
 	sort.Strings(logItemFieldList)
+	initCanonicalFields()
 }
 
 func (l *LogItem) normalise() {
@@ -203,7 +237,8 @@ func (l *LogItem) normalise() {
 	if l.OriginatorTime.IsZero() {
 		l.OriginatorTime = l.Time
 	}
-	l.FormatVersion = 1
+	l.mapStructuredData()
+	l.FormatVersion = formatVersion
 	l.Verified = false
 }
 
@@ -221,10 +256,16 @@ func facilityToString(l int) string {
 	return fmt.Sprintf("unknown [%d]", l)
 }
 
-func (l *LogItem) makeHash() {
+// The hash preimage used by format versions 1 and 2: each field's value
+// followed by a zero byte. Fields added since are tagged 'nolegacy' and
+// omitted entirely, so as not to change the hashes of existing items.
+func (l *LogItem) legacyHashFields() []byte {
 	var b bytes.Buffer
 	str := structs.New(l)
 	for _, k := range logItemFieldList {
+		if hasFieldProperty(k, fpNoLegacy) {
+			continue
+		}
 		v, ok := str.FieldOk(k)
 		if ok {
 			if !hasFieldProperty(k, fpNoHash) {
@@ -248,78 +289,144 @@ func (l *LogItem) makeHash() {
 		}
 		b.WriteByte(0)
 	}
-	fmt.Fprintf(&b, "%s", hashSecret)
-	sha := sha256.Sum256(b.Bytes())
-	l.Hash = fmt.Sprintf("%064x", sha)
+	return b.Bytes()
 }
 
-func (l *LogItem) checkHash() bool {
+/*
+ * Format versions:
+ *
+ * 1. SHA-256 of the legacy fields followed by the hash secret
+ * 2. HMAC-SHA256 of the legacy fields keyed with the hash secret
+ * 3. HMAC-SHA256 of the canonical encoding (see canonical.go) keyed with
+ *    the hash secret
+ *
+ * In each case the hash secret is that of the item's KeyId (see hashkey.go).
+ * An item whose KeyId is not in the keyring is never hashed (with an empty
+ * secret or otherwise), so gets an empty hash and errUnknownHashKey.
+ *
+ * An item with an unknown format version gets an empty hash, so will never
+ * verify
+ */
+func (l *LogItem) makeHash() error {
+	secret, ok := l.hashSecret()
+	if !ok {
+		l.Hash = ""
+		return errUnknownHashKey
+	}
+	switch l.FormatVersion {
+	case 1:
+		var b bytes.Buffer
+		b.Write(l.legacyHashFields())
+		fmt.Fprintf(&b, "%s", secret)
+		sha := sha256.Sum256(b.Bytes())
+		l.Hash = fmt.Sprintf("%064x", sha)
+	case 2:
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(l.legacyHashFields())
+		l.Hash = fmt.Sprintf("%064x", mac.Sum(nil))
+	case 3:
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(l.canonicalHashFields())
+		l.Hash = fmt.Sprintf("%064x", mac.Sum(nil))
+	default:
+		l.Hash = ""
+	}
+	return nil
+}
+
+var (
+	errUnknownHashKey = errors.New("unknown hash key")
+	errBadHash        = errors.New("hash does not match")
+)
+
+// Check an item's hash, returning errUnknownHashKey if its key is not in
+// the keyring or errBadHash if the hash does not match
+func (l *LogItem) checkHash() error {
 	tl := *l
-	tl.makeHash()
+	if err := tl.makeHash(); err != nil {
+		return err
+	}
 	// Constant time compare probably unnecessary but let's err on the
 	// side of caution
-	//log.Printf("Compare: %s = %s", tl.Hash, l.Hash)
-	return subtle.ConstantTimeCompare([]byte(tl.Hash), []byte(l.Hash)) == 1
+	if tl.Hash == "" || subtle.ConstantTimeCompare([]byte(tl.Hash), []byte(l.Hash)) != 1 {
+		return errBadHash
+	}
+	return nil
 }
 
-func (l *LogItem) makeHashAndInsert(db *Database) {
-	//start := time.Now()
-	sessionCopy := db.mongoSession.Copy()
-	defer func() {
-		sessionCopy.Close()
-		//log.Printf("Time to insert = %s\n", time.Since(start))
-	}()
-
-	// Convert to BSON and back to round times properly
+// Convert to BSON and back to round times properly
+func (l *LogItem) roundTimes() {
 	bytes, err := bson.Marshal(l)
 	if err != nil {
 		log.Panic("Cannot BSON marshal logitem")
 	}
-	if err := bson.Unmarshal(bytes, &l); err != nil {
+	if err := bson.Unmarshal(bytes, l); err != nil {
 		log.Panic("Cannot BSON unmarshal logitem")
 	}
+}
 
-	l.ShardGroup = shardGroup
-	backoff := initialBackoff
-
-	c := db.getLogItemCollection(sessionCopy)
-
-	for iteration := 0; ; iteration++ {
-		var previous LogItem = LogItem{}
-		if err := c.Find(bson.M{"shardgroup": l.ShardGroup}).Select(bson.M{"sequenceid": 1, "hash": 1}).Sort("-sequenceid").Limit(1).One(&previous); err != nil {
-			if err != mgo.ErrNotFound {
-				log.Panicf("Query returned error %v\n", err)
-			}
-			l.PreviousHash = ""
-			l.SequenceId = 0
-		} else {
-			l.PreviousHash = previous.Hash
-			l.SequenceId = previous.SequenceId + 1
+// Whether any field hashed only by the canonical encoding is set
+func (l *LogItem) hasNoLegacyFields() bool {
+	str := structs.New(l)
+	for _, k := range logItemFieldList {
+		if !hasFieldProperty(k, fpNoLegacy) || hasFieldProperty(k, fpNoHash) {
+			continue
 		}
-		l.makeHash()
-		err := c.Insert(l)
-		if err == nil {
-			if backoff >= maximumBackoff {
-				log.Printf("Succeeded only after %d iterations\n", iteration)
+		switch t := str.Field(k).Value().(type) {
+		case []SDElement:
+			if len(t) > 0 {
+				return true
 			}
-			l.Verified = true
-			break
-		}
-		if !mgo.IsDup(err) {
-			log.Panicf("Could not insert record %v\n", err)
-		}
-		if iteration >= iterationsBeforeBackoff {
-			time.Sleep(time.Duration(1+rand.Int()%backoff) * time.Microsecond)
-			backoff *= 2
-			if backoff > maximumBackoff {
-				backoff = maximumBackoff
+		case map[string]string:
+			if len(t) > 0 {
+				return true
+			}
+		default:
+			if !str.Field(k).IsZero() {
+				return true
 			}
 		}
 	}
+	return false
+}
+
+// Set the key used to hash the item. Fields such as KeyId are only hashed
+// from format version 3, so items using any of them use at least that.
+func (l *LogItem) setHashKey(k *hashKey) {
+	l.KeyId = k.id
+	if l.FormatVersion < 3 && l.hasNoLegacyFields() {
+		l.FormatVersion = 3
+	}
+}
+
+// Chain an item onto the end of its shard group's chain, which the caller
+// must already have set
+func (l *LogItem) makeHashAndInsert(db *Database) {
+	insertLogItems(db, []*LogItem{l})
 }
 
-// Returns whether the set of result values has been validated as complete
-func queryLogItems(db *Database, query interface{}, sortOrder []string, limit int, ch chan LogItem) (int, bool) {
+// As makeHashAndInsert, for several items at once
+func insertLogItems(db *Database, items []*LogItem) {
+	for _, l := range items {
+		l.roundTimes()
+	}
+	sequenceLogItems(db, items, false)
+}
+
+type queryStatus struct {
+	Count     int
+	Truncated bool
+	Complete  bool
+	Shards    []*chainReport
+}
+
+// Returns whether the set of result values has been validated as complete,
+// i.e. the results were not truncated by the limit and, for each shard
+// group, form a contiguous range of its chain where every item's hash and
+// link to its predecessor verifies. If ranges is not nil, the results are
+// restricted to those ranges of each shard group's chain, and must cover
+// them to be complete.
+func queryLogItems(db *Database, query interface{}, sortOrder []string, limit int, ranges []*shardRange, ch chan LogItem) *queryStatus {
 	start := time.Now()
 	sessionCopy := db.mongoSession.Copy()
 	defer func() {
@@ -327,24 +434,51 @@ func queryLogItems(db *Database, query interface{}, sortOrder []string, limit in
 		log.Printf("Time to reply = %s\n", time.Since(start))
 	}()
 
-	items := 0
+	status := &queryStatus{}
+	checker := newResultChecker()
 	c := db.getLogItemCollection(sessionCopy)
 
+	if ranges != nil {
+		if query == nil {
+			query = shardRangeQuery(ranges)
+		} else {
+			query = bson.M{"$and": []interface{}{query, shardRangeQuery(ranges)}}
+		}
+		for _, r := range ranges {
+			checker.expect(r.ShardGroup, r.From, r.To)
+		}
+	}
+
 	q := c.Find(query).Sort(append(sortOrder, "_id")...)
 	if limit > 0 {
-		q = q.Limit(limit)
+		// Fetch one more than we need so we know whether we truncated
+		q = q.Limit(limit + 1)
 	}
 	iter := q.Iter()
 	defer iter.Close()
 
 	var result LogItem
 	for iter.Next(&result) {
-		result.Verified = result.checkHash()
+		if limit > 0 && status.Count >= limit {
+			status.Truncated = true
+			break
+		}
+		err := result.checkHash()
+		result.Verified = err == nil
+		checker.add(&result, err)
 		ch <- result
-		items++
+		status.Count++
 	}
 	if err := iter.Err(); err != nil {
 		log.Panicf("Error while iterating: %v\n", err)
 	}
-	return items, true
+
+	status.Shards = checker.finish()
+	status.Complete = !status.Truncated
+	for _, r := range status.Shards {
+		if !r.Intact {
+			status.Complete = false
+		}
+	}
+	return status
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"labix.org/v2/mgo/bson"
+	"testing"
+	"time"
+)
+
+func setupHashTest(t *testing.T) {
+	logItemFieldList = nil
+	initFieldProperties()
+	saved := hashKeys
+	hashKeys = []hashKey{{secret: "secret"}, {id: "k1", secret: "secret3"}}
+	t.Cleanup(func() { hashKeys = saved })
+}
+
+// An item with every legacy field set, and with formatVersion 3 every other
+// field too
+func hashTestItem(formatVersion int) *LogItem {
+	ts := time.Unix(1700000000, 123000000)
+	l := &LogItem{
+		Message:        "hello\x00world",
+		InstanceId:     "i-1",
+		AccountGroupId: "ag",
+		Level:          "info",
+		OriginatorTime: ts,
+		Pid:            42,
+		OriginatorIp:   "10.0.0.1",
+		OriginatorPort: 514,
+		Facility:       "local0",
+		Hostname:       "host1",
+		User:           "u",
+		Time:           ts,
+		LevelNo:        6,
+		PreviousHash:   "abababababababababababababababababababababababababababababababab",
+		SequenceId:     7,
+		ShardGroup:     1234,
+		FormatVersion:  formatVersion,
+		ClientName:     "client",
+	}
+	if formatVersion >= 3 {
+		l.KeyId = "k1"
+		l.AppName = "app"
+		l.StructuredData = []SDElement{{Id: "ex@1", Params: []SDParam{{Name: "a", Value: "1"}, {Name: "b", Value: ""}}}}
+		l.TraceId = "5b8efff798038103d269b633813fc60c"
+		l.SpanId = "eee19b7ec3c1b174"
+		l.Attributes = map[string]string{"z": "1", "a": "2"}
+	}
+	return l
+}
+
+func TestMakeHashGolden(t *testing.T) {
+	setupHashTest(t)
+	for _, tc := range []struct {
+		formatVersion int
+		hash          string
+	}{
+		{1, "e7a54b3142b866973a92128bfe6ec1709b4a9840a762c3c65a73ea02d67bee94"},
+		{2, "6b057370ae2c64425577ba915b49228bbdca389c67cc158e8b543aeeddbdeb75"},
+		{3, "2ce41199604f21db016163eac5e6d0984d734a7d1c1c69132c1f6ef6376896c1"},
+	} {
+		l := hashTestItem(tc.formatVersion)
+		if err := l.makeHash(); err != nil {
+			t.Errorf("version %d: makeHash returned %v", tc.formatVersion, err)
+		}
+		if l.Hash != tc.hash {
+			t.Errorf("version %d: hash = %s, want %s", tc.formatVersion, l.Hash, tc.hash)
+		}
+		if err := l.checkHash(); err != nil {
+			t.Errorf("version %d: checkHash returned %v", tc.formatVersion, err)
+		}
+	}
+}
+
+func TestCheckHashFailures(t *testing.T) {
+	setupHashTest(t)
+	for _, tc := range []struct {
+		name   string
+		modify func(l *LogItem)
+		err    error
+	}{
+		{"changed message", func(l *LogItem) { l.Message = "hello" }, errBadHash},
+		{"changed sequence id", func(l *LogItem) { l.SequenceId++ }, errBadHash},
+		{"changed attribute", func(l *LogItem) { l.Attributes["a"] = "3" }, errBadHash},
+		{"changed key id", func(l *LogItem) { l.KeyId = "" }, errBadHash},
+		{"unknown key id", func(l *LogItem) { l.KeyId = "k2" }, errUnknownHashKey},
+		{"unknown format version", func(l *LogItem) { l.FormatVersion = 4 }, errBadHash},
+		{"empty hash", func(l *LogItem) { l.Hash = "" }, errBadHash},
+	} {
+		l := hashTestItem(3)
+		if err := l.makeHash(); err != nil {
+			t.Fatalf("makeHash returned %v", err)
+		}
+		tc.modify(l)
+		if err := l.checkHash(); err != tc.err {
+			t.Errorf("%s: checkHash returned %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestMakeHashUnknownKey(t *testing.T) {
+	setupHashTest(t)
+	for _, formatVersion := range []int{1, 2, 3} {
+		l := hashTestItem(formatVersion)
+		l.KeyId = "k2"
+		l.Hash = "stale"
+		if err := l.makeHash(); err != errUnknownHashKey || l.Hash != "" {
+			t.Errorf("version %d: makeHash gave %q, %v; want no hash and %v", formatVersion, l.Hash, err, errUnknownHashKey)
+		}
+	}
+}
+
+// The pending id of a queued item is not hashed, and does not force the
+// canonical encoding
+func TestPendingIdNotHashed(t *testing.T) {
+	setupHashTest(t)
+	for _, formatVersion := range []int{1, 2, 3} {
+		want := hashTestItem(formatVersion)
+		want.makeHash()
+		l := hashTestItem(formatVersion)
+		l.PendingId = bson.NewObjectId()
+		if formatVersion < 3 {
+			l.setHashKey(&hashKeys[0])
+		}
+		if l.makeHash(); l.FormatVersion != formatVersion || l.Hash != want.Hash {
+			t.Errorf("version %d: got version %d and hash %s, want %s", formatVersion, l.FormatVersion, l.Hash, want.Hash)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * The Loki push API, POST /loki/api/v1/push, as used by Promtail, Grafana
+ * Agent and Alloy. The request is either a snappy compressed protobuf
+ * PushRequest (application/x-protobuf, the default), or JSON
+ * (application/json, optionally gzipped) of the form
+ *
+ *   { "streams": [ { "stream": { "label": "value", ... },
+ *                    "values": [ [ "<unix ns>", "<line>", { metadata } ], ... ] } ] }
+ *
+ * Each entry becomes a LogItem with the line as its message. Its stream's
+ * labels, then its structured metadata if any, map onto LogItem fields as
+ * follows, and any others are kept as attributes:
+ *
+ *   host or hostname -> hostname, level, severity or detected_level -> level,
+ *   app or service_name -> app_name, facility -> facility, pid -> pid,
+ *   user -> user, instance_id -> instance_id,
+ *   account_group_id -> account_group_id, trace_id -> trace_id,
+ *   span_id -> span_id
+ *
+ * As Loki does, we reply 204 once every entry has been committed.
+ */
+
+const lokiMaxBodyLen = 64 * 1024 * 1024
+
+type lokiLabel struct {
+	name  string
+	value string
+}
+
+type lokiEntry struct {
+	time     time.Time
+	line     string
+	metadata []lokiLabel
+}
+
+type lokiStream struct {
+	labels  []lokiLabel
+	entries []lokiEntry
+}
+
+// Parse labels in Prometheus form, e.g. {job="varlogs", host="h1"}
+func parseLokiLabels(s string) ([]lokiLabel, error) {
+	s = strings.TrimSpace(s)
+	if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+		return nil, errors.New("Loki labels must be enclosed in braces")
+	}
+	s = strings.TrimSpace(s[1 : len(s)-1])
+	var labels []lokiLabel
+	for s != "" {
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, errors.New("Loki label has no name")
+		}
+		label := lokiLabel{name: strings.TrimSpace(s[:eq])}
+		s = strings.TrimSpace(s[eq+1:])
+		if !strings.HasPrefix(s, `"`) {
+			return nil, errors.New("Loki label value is not quoted")
+		}
+		// Find the closing quote, skipping escapes
+		end := 1
+		for ; end < len(s) && s[end] != '"'; end++ {
+			if s[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(s) {
+			return nil, errors.New("Loki label value is not terminated")
+		}
+		value, err := strconv.Unquote(s[:end+1])
+		if err != nil {
+			return nil, err
+		}
+		label.value = value
+		labels = append(labels, label)
+		s = strings.TrimSpace(s[end+1:])
+		if strings.HasPrefix(s, ",") {
+			s = strings.TrimSpace(s[1:])
+		} else if s != "" {
+			return nil, errors.New("Loki labels must be separated by commas")
+		}
+	}
+	return labels, nil
+}
+
+// Order labels from JSON objects by name, so they map the same way each time
+func sortLokiLabels(labels []lokiLabel) {
+	sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+}
+
+func lokiDecodeLabelPair(p *protoReader) lokiLabel {
+	var l lokiLabel
+	for p.next() {
+		switch p.field {
+		case 1:
+			l.name = p.string()
+		case 2:
+			l.value = p.string()
+		default:
+			p.skip()
+		}
+	}
+	return l
+}
+
+func lokiDecodeEntry(p *protoReader) lokiEntry {
+	var e lokiEntry
+	for p.next() {
+		switch p.field {
+		case 1:
+			// A google.protobuf.Timestamp
+			var seconds, nanos int64
+			for q := p.message(); q.next(); {
+				switch q.field {
+				case 1:
+					seconds = q.int64()
+				case 2:
+					nanos = q.int64()
+				default:
+					q.skip()
+				}
+			}
+			e.time = time.Unix(seconds, nanos)
+		case 2:
+			e.line = p.string()
+		case 3:
+			e.metadata = append(e.metadata, lokiDecodeLabelPair(p.message()))
+		default:
+			p.skip()
+		}
+	}
+	return e
+}
+
+func lokiDecodePushRequest(b []byte) ([]lokiStream, error) {
+	var streams []lokiStream
+	p := newProtoReader(b)
+	for p.next() {
+		if p.field != 1 {
+			p.skip()
+			continue
+		}
+		var stream lokiStream
+		for q := p.message(); q.next(); {
+			switch q.field {
+			case 1:
+				labels, err := parseLokiLabels(q.string())
+				if err != nil {
+					return nil, err
+				}
+				stream.labels = labels
+			case 2:
+				stream.entries = append(stream.entries, lokiDecodeEntry(q.message()))
+			default:
+				q.skip()
+			}
+		}
+		streams = append(streams, stream)
+	}
+	if err := p.error(); err != nil {
+		return nil, err
+	}
+	return streams, nil
+}
+
+func lokiDecodeJSON(b []byte) ([]lokiStream, error) {
+	var req struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][]interface{}   `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(b, &req); err != nil {
+		return nil, err
+	}
+	var streams []lokiStream
+	for _, s := range req.Streams {
+		var stream lokiStream
+		for name, value := range s.Stream {
+			stream.labels = append(stream.labels, lokiLabel{name, value})
+		}
+		sortLokiLabels(stream.labels)
+		for _, v := range s.Values {
+			if len(v) < 2 || len(v) > 3 {
+				return nil, errors.New("Loki values must be [ timestamp, line ] or [ timestamp, line, metadata ]")
+			}
+			ts, ok := v[0].(string)
+			if !ok {
+				return nil, errors.New("Loki timestamps must be strings")
+			}
+			ns, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil {
+				return nil, err
+			}
+			line, ok := v[1].(string)
+			if !ok {
+				return nil, errors.New("Loki lines must be strings")
+			}
+			e := lokiEntry{time: time.Unix(0, ns), line: line}
+			if len(v) == 3 {
+				metadata, ok := v[2].(map[string]interface{})
+				if !ok {
+					return nil, errors.New("Loki structured metadata must be an object")
+				}
+				for name, value := range metadata {
+					e.metadata = append(e.metadata, lokiLabel{name, attributeString(value)})
+				}
+				sortLokiLabels(e.metadata)
+			}
+			stream.entries = append(stream.entries, e)
+		}
+		streams = append(streams, stream)
+	}
+	return streams, nil
+}
+
+func (l *LogItem) setLokiLabel(label lokiLabel) {
+	switch label.name {
+	case "host", "hostname":
+		l.Hostname = label.value
+	case "level", "severity", "detected_level":
+		l.Level = label.value
+	case "app", "service_name":
+		l.AppName = label.value
+	case "facility":
+		l.Facility = label.value
+	case "pid":
+		if pid, err := strconv.Atoi(label.value); err == nil {
+			l.Pid = pid
+		} else {
+			l.setAttribute(label.name, label.value)
+		}
+	case "user":
+		l.User = label.value
+	case "instance_id":
+		l.InstanceId = label.value
+	case "account_group_id":
+		l.AccountGroupId = label.value
+	case "trace_id":
+		l.TraceId = strings.ToLower(label.value)
+	case "span_id":
+		l.SpanId = strings.ToLower(label.value)
+	default:
+		l.setAttribute(label.name, label.value)
+	}
+}
+
+func lokiPush(c *Context, w http.ResponseWriter, r *http.Request) {
+	body, err := readRequestBody(r, lokiMaxBodyLen)
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var streams []lokiStream
+	if contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); contentType == "application/json" {
+		streams, err = lokiDecodeJSON(body)
+	} else {
+		if body, err = snappyDecode(body, lokiMaxBodyLen); err == nil {
+			streams, err = lokiDecodePushRequest(body)
+		}
+	}
+	if err != nil {
+		// Promtail does not retry a 400
+		http.Error(w, "Cannot parse push request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var items []*LogItem
+	for _, stream := range streams {
+		for _, e := range stream.entries {
+			l := &LogItem{Message: e.line, OriginatorTime: e.time}
+			for _, label := range stream.labels {
+				l.setLokiLabel(label)
+			}
+			for _, label := range e.metadata {
+				l.setLokiLabel(label)
+			}
+			l.setRequestOrigin(r)
+			l.normalise()
+			l.assignShardGroup(c.listener)
+			items = append(items, l)
+		}
+	}
+	insertLogItems(c.db, items)
+
+	w.WriteHeader(http.StatusNoContent)
+}
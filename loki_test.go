@@ -0,0 +1,193 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func lokiTestLabel(name string, value string) []byte {
+	return protoTestCat(protoTestStringField(1, name), protoTestStringField(2, value))
+}
+
+func lokiTestEntry(seconds int64, nanos int64, line string, metadata ...[]byte) []byte {
+	b := protoTestCat(
+		protoTestBytesField(1, protoTestCat(protoTestVarintField(1, uint64(seconds)), protoTestVarintField(2, uint64(nanos)))),
+		protoTestStringField(2, line),
+	)
+	for _, m := range metadata {
+		b = protoTestCat(b, protoTestBytesField(3, m))
+	}
+	return b
+}
+
+func lokiTestStream(labels string, entries ...[]byte) []byte {
+	b := protoTestStringField(1, labels)
+	for _, e := range entries {
+		b = protoTestCat(b, protoTestBytesField(2, e))
+	}
+	return protoTestCat(protoTestBytesField(1, protoTestCat(b, protoTestVarintField(3, 99))))
+}
+
+func TestParseLokiLabels(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []lokiLabel
+	}{
+		{`{}`, nil},
+		{` { } `, nil},
+		{`{job="varlogs"}`, []lokiLabel{{"job", "varlogs"}}},
+		{`{job="varlogs", host="h1",level = "warn" }`, []lokiLabel{{"job", "varlogs"}, {"host", "h1"}, {"level", "warn"}}},
+		{`{quote="a\"b,c", nl="x\ny"}`, []lokiLabel{{"quote", `a"b,c`}, {"nl", "x\ny"}}},
+		{`{empty=""}`, []lokiLabel{{"empty", ""}}},
+	} {
+		got, err := parseLokiLabels(tc.in)
+		if err != nil {
+			t.Errorf("%s: %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseLokiLabelsMalformed(t *testing.T) {
+	for _, in := range []string{
+		``,
+		`job="varlogs"`,
+		`{job="varlogs"`,
+		`{="x"}`,
+		`{job}`,
+		`{job=varlogs}`,
+		`{job="varlogs}`,
+		`{job="varlogs\"}`,
+		`{job="varlogs" host="h1"}`,
+		`{job="\q"}`,
+	} {
+		if got, err := parseLokiLabels(in); err == nil {
+			t.Errorf("%s: accepted as %v", in, got)
+		}
+	}
+}
+
+func TestLokiDecodePushRequest(t *testing.T) {
+	entry := lokiTestEntry(1700000000, 5, "line one", lokiTestLabel("trace_id", "ABC"))
+	in := protoTestCat(
+		lokiTestStream(`{host="h1", job="j"}`, entry, lokiTestEntry(1700000001, 0, "line two")),
+		lokiTestStream(`{}`),
+	)
+	streams, err := lokiDecodePushRequest(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 2 || len(streams[0].entries) != 2 || len(streams[1].entries) != 0 {
+		t.Fatalf("got %+v", streams)
+	}
+	if want := []lokiLabel{{"host", "h1"}, {"job", "j"}}; !reflect.DeepEqual(streams[0].labels, want) {
+		t.Errorf("labels %v", streams[0].labels)
+	}
+	e := streams[0].entries[0]
+	if e.line != "line one" || e.time.UnixNano() != 1700000000000000005 ||
+		!reflect.DeepEqual(e.metadata, []lokiLabel{{"trace_id", "ABC"}}) {
+		t.Errorf("got %+v", e)
+	}
+	if e = streams[0].entries[1]; e.line != "line two" || e.time.UnixNano() != 1700000001000000000 || e.metadata != nil {
+		t.Errorf("got %+v", e)
+	}
+
+	// Compressed, as sent
+	body := snappyTestBlock(uint64(len(in)), snappyTestLiteral(in))
+	dec, err := snappyDecode(body, lokiMaxBodyLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressed, err := lokiDecodePushRequest(dec); err != nil || !reflect.DeepEqual(compressed, streams) {
+		t.Errorf("compressed request decoded as %+v, %v", compressed, err)
+	}
+}
+
+func TestLokiDecodePushRequestMalformed(t *testing.T) {
+	valid := lokiTestStream(`{job="j"}`, lokiTestEntry(1, 0, "x"))
+	for _, tc := range []struct {
+		name string
+		in   []byte
+	}{
+		{"truncated", valid[:len(valid)-1]},
+		{"stream as varint", protoTestVarintField(1, 1)},
+		{"bad labels", lokiTestStream(`job="j"`)},
+		{"labels as varint", protoTestBytesField(1, protoTestVarintField(1, 1))},
+		{"entry as varint", protoTestBytesField(1, protoTestVarintField(2, 1))},
+		{"line as varint", lokiTestStream(`{}`, protoTestVarintField(2, 1))},
+		{"timestamp as varint", lokiTestStream(`{}`, protoTestVarintField(1, 1))},
+		{"seconds as string", lokiTestStream(`{}`, protoTestBytesField(1, protoTestStringField(1, "x")))},
+		{"metadata as varint", lokiTestStream(`{}`, protoTestVarintField(3, 1))},
+		{"metadata value as varint", lokiTestStream(`{}`, protoTestBytesField(3, protoTestVarintField(2, 1)))},
+	} {
+		if got, err := lokiDecodePushRequest(tc.in); err == nil {
+			t.Errorf("%s: accepted as %+v", tc.name, got)
+		}
+	}
+}
+
+func TestLokiDecodeJSON(t *testing.T) {
+	js := `{"streams":[{"stream":{"x":"y","app":"a"},"values":[
+		["1700000000000000001","hi"],
+		["1700000000000000002","there",{"pid":"12","n":3}]]}]}`
+	streams, err := lokiDecodeJSON([]byte(js))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 1 || len(streams[0].entries) != 2 {
+		t.Fatalf("got %+v", streams)
+	}
+	if want := []lokiLabel{{"app", "a"}, {"x", "y"}}; !reflect.DeepEqual(streams[0].labels, want) {
+		t.Errorf("labels %v", streams[0].labels)
+	}
+	e := streams[0].entries[1]
+	if e.line != "there" || e.time.UnixNano() != 1700000000000000002 ||
+		!reflect.DeepEqual(e.metadata, []lokiLabel{{"n", "3"}, {"pid", "12"}}) {
+		t.Errorf("got %+v", e)
+	}
+
+	for _, bad := range []string{
+		`{"streams":[`,
+		`{"streams":[{"values":[["1"]]}]}`,
+		`{"streams":[{"values":[["1","x",{},"y"]]}]}`,
+		`{"streams":[{"values":[[1,"x"]]}]}`,
+		`{"streams":[{"values":[["x","x"]]}]}`,
+		`{"streams":[{"values":[["99999999999999999999","x"]]}]}`,
+		`{"streams":[{"values":[["1",2]]}]}`,
+		`{"streams":[{"values":[["1","x","y"]]}]}`,
+		`{"streams":[{"stream":{"a":1}}]}`,
+	} {
+		if got, err := lokiDecodeJSON([]byte(bad)); err == nil {
+			t.Errorf("%s: accepted as %+v", bad, got)
+		}
+	}
+}
+
+func TestSetLokiLabel(t *testing.T) {
+	initFieldProperties()
+	l := &LogItem{}
+	for _, label := range []lokiLabel{
+		{"host", "h1"}, {"detected_level", "warn"}, {"service_name", "svc"}, {"facility", "local0"},
+		{"pid", "42"}, {"user", "u"}, {"instance_id", "i"}, {"account_group_id", "g"},
+		{"trace_id", "5B8EFFF798038103D269B633813FC60C"}, {"span_id", "EEE19B7EC3C1B174"},
+		{"job", "j"}, {"k8s.pod", "p"},
+	} {
+		l.setLokiLabel(label)
+	}
+	if l.Hostname != "h1" || l.Level != "warn" || l.AppName != "svc" || l.Facility != "local0" || l.Pid != 42 ||
+		l.User != "u" || l.InstanceId != "i" || l.AccountGroupId != "g" ||
+		l.TraceId != "5b8efff798038103d269b633813fc60c" || l.SpanId != "eee19b7ec3c1b174" ||
+		l.Attributes["job"] != "j" || l.Attributes["k8s_pod"] != "p" {
+		t.Errorf("got %+v", l)
+	}
+
+	// A pid which is not a number is kept as an attribute
+	l = &LogItem{}
+	l.setLokiLabel(lokiLabel{"pid", "abc"})
+	if l.Pid != 0 || l.Attributes["pid"] != "abc" {
+		t.Errorf("got %+v", l)
+	}
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
-	"fmt"
+	"log"
 	"math/rand"
 	"os"
-	"os/exec"
+	"strings"
 	"time"
 )
 
@@ -12,24 +12,37 @@ import (
  * TODO:
  *
  * + Config file
- * + Sharding and shard index
  * + SSL and client certificate handling
- * + Merkle thread
  */
 
-func killPrevious() {
-	// A hack to kill previous instances
-	pid := os.Getpid()
-	exec.Command("sh", "-c", "pgrep slogger | fgrep -v '^"+fmt.Sprintf("%d", pid)+"$' | xargs kill").Run()
-	time.Sleep(500 * time.Millisecond)
-}
-
 func main() {
 	rand.Seed(time.Now().UnixNano())
-	killPrevious()
-	readConfig()
-	buildJsonMap()
-	initFieldProperties()
-	db := newDatabase()
-	startServices(db)
+
+	// A first argument not starting with '-' is a subcommand
+	command := ""
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
+
+	switch command {
+	case "":
+		readConfig()
+		loadSigningKey()
+		buildJsonMap()
+		initFieldProperties()
+		db := newDatabase()
+		startLeases(db)
+		startChainHeads(db)
+		startMerkleThread(db)
+		startShardIndex(db)
+		startScanner(db)
+		startServices(db)
+	case "export":
+		exportMain()
+	case "verify-file":
+		verifyFileMain()
+	default:
+		log.Fatalf("Unknown command %s: must be export or verify-file", command)
+	}
 }
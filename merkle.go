@@ -0,0 +1,675 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"time"
+)
+
+/*
+ * The Merkle thread folds the items of each shard group into an RFC 6962
+ * (Certificate Transparency) style Merkle tree. Leaf n of the tree for a
+ * shard group is the item with SequenceId n, and the leaf data is the raw
+ * (hex decoded) value of its Hash. As per RFC 6962:
+ *
+ *   leaf hash = SHA-256(0x00 || leaf data)
+ *   node hash = SHA-256(0x01 || left || right)
+ *   MTH({})   = SHA-256("")
+ *
+ * We persist every complete subtree as a merkleNode, identified by its
+ * level (0 for leaves) and its index within that level; a node at level l
+ * and index i covers leaves [i*2^l, (i+1)*2^l). As every subtree used by
+ * the RFC 6962 algorithms is either complete or made up of complete
+ * subtrees, any root or proof can be computed from these. Periodically we
+ * also record a TreeHead giving the size and root hash of the tree.
+ */
+
+var (
+	merkleInterval     = 10 // Seconds between folds; 0 disables the Merkle thread
+	merkleBatchSize    = 10000
+	merkleNodeCollName = "merklenodes"
+	treeHeadCollName   = "treeheads"
+)
+
+type merkleNode struct {
+	ShardGroup int
+	Level      int
+	Index      int64
+	Hash       string
+}
+
+type TreeHead struct {
+	ShardGroup int       `json:"shard_group"`
+	TreeSize   int64     `json:"tree_size"`
+	RootHash   string    `json:"root_hash"`
+	Time       time.Time `json:"timestamp"`
+}
+
+func merkleLeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func merkleNodeHash(left []byte, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+func merkleEmptyHash() []byte {
+	sha := sha256.Sum256(nil)
+	return sha[:]
+}
+
+// The leaf hash for a log item
+func (l *LogItem) merkleLeaf() []byte {
+	data, err := hex.DecodeString(l.Hash)
+	if err != nil {
+		// Should never happen as we generate the hash ourselves, but if it
+		// does the tree must still be built
+		data = []byte(l.Hash)
+	}
+	return merkleLeafHash(data)
+}
+
+func decodeMerkleHash(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		log.Panicf("Corrupt merkle hash %s", s)
+	}
+	return b
+}
+
+// Largest power of two strictly less than n (n must be at least 2)
+func largestPowerOfTwoBelow(n int64) int64 {
+	k := int64(1)
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// A merkleStore gives access to the persisted nodes of one shard group
+type merkleStore struct {
+	shardGroup int
+	nodes      *mgo.Collection
+	unsaved    []interface{} // Nodes queued by a fold, not yet inserted
+}
+
+func newMerkleStore(db *Database, s *mgo.Session, shardGroup int) *merkleStore {
+	return &merkleStore{shardGroup: shardGroup, nodes: db.getMerkleNodeCollection(s)}
+}
+
+func (m *merkleStore) put(level int, index int64, hash []byte) {
+	node := merkleNode{ShardGroup: m.shardGroup, Level: level, Index: index, Hash: hex.EncodeToString(hash)}
+	if err := m.nodes.Insert(&node); err != nil && !mgo.IsDup(err) {
+		log.Panicf("Could not insert merkle node %v\n", err)
+	}
+}
+
+// Queue a node to be inserted by the next flush
+func (m *merkleStore) queue(level int, index int64, hash []byte) {
+	m.unsaved = append(m.unsaved, &merkleNode{ShardGroup: m.shardGroup, Level: level, Index: index, Hash: hex.EncodeToString(hash)})
+}
+
+// Insert the queued nodes together. Should any already exist (as another
+// instance may have folded the same leaves) insert them one at a time.
+func (m *merkleStore) flush() {
+	if len(m.unsaved) == 0 {
+		return
+	}
+	if err := m.nodes.Insert(m.unsaved...); err != nil {
+		if !mgo.IsDup(err) {
+			log.Panicf("Could not insert merkle nodes %v\n", err)
+		}
+		for _, node := range m.unsaved {
+			if err := m.nodes.Insert(node); err != nil && !mgo.IsDup(err) {
+				log.Panicf("Could not insert merkle node %v\n", err)
+			}
+		}
+	}
+	m.unsaved = nil
+}
+
+// The hash of the complete subtree at a given level and index. If the node
+// is missing (for instance because we crashed part way through a fold) it is
+// recomputed from its children and persisted. Returns false if the leaves it
+// covers have not yet been folded into the tree.
+func (m *merkleStore) subtree(level int, index int64) ([]byte, bool) {
+	var node merkleNode
+	err := m.nodes.Find(bson.M{"shardgroup": m.shardGroup, "level": level, "index": index}).One(&node)
+	if err == nil {
+		return decodeMerkleHash(node.Hash), true
+	}
+	if err != mgo.ErrNotFound {
+		log.Panicf("Query returned error %v\n", err)
+	}
+	if level == 0 {
+		return nil, false
+	}
+	left, ok := m.subtree(level-1, 2*index)
+	if !ok {
+		return nil, false
+	}
+	right, ok := m.subtree(level-1, 2*index+1)
+	if !ok {
+		return nil, false
+	}
+	hash := merkleNodeHash(left, right)
+	m.put(level, index, hash)
+	return hash, true
+}
+
+// MTH(D[start:end]) as defined in RFC 6962. 'start' must be a multiple of the
+// largest power of two no greater than end-start, which is always the case for
+// the subtrees used by the RFC 6962 algorithms.
+func (m *merkleStore) treeHash(start int64, end int64) ([]byte, bool) {
+	n := end - start
+	if n == 0 {
+		return merkleEmptyHash(), true
+	}
+	if n&(n-1) == 0 {
+		level := 0
+		for int64(1)<<uint(level) < n {
+			level++
+		}
+		return m.subtree(level, start>>uint(level))
+	}
+	k := largestPowerOfTwoBelow(n)
+	left, ok := m.treeHash(start, start+k)
+	if !ok {
+		return nil, false
+	}
+	right, ok := m.treeHash(start+k, end)
+	if !ok {
+		return nil, false
+	}
+	return merkleNodeHash(left, right), true
+}
+
+// The number of leaves folded into the tree, i.e. one more than the highest
+// index at level 0
+func (m *merkleStore) size() int64 {
+	var node merkleNode
+	if err := m.nodes.Find(bson.M{"shardgroup": m.shardGroup, "level": 0}).Sort("-index").One(&node); err != nil {
+		if err != mgo.ErrNotFound {
+			log.Panicf("Query returned error %v\n", err)
+		}
+		return 0
+	}
+	return node.Index + 1
+}
+
+/*
+ * A merkleFrontier holds the roots of the complete subtrees making up the
+ * right hand edge of the tree, largest first. There is one for each bit set
+ * in the tree size. This is all we need to append leaves and to compute
+ * the root hash.
+ */
+type merkleFrontier struct {
+	size   int64
+	levels []int
+	hashes [][]byte
+}
+
+func loadMerkleFrontier(m *merkleStore) *merkleFrontier {
+	f := &merkleFrontier{size: m.size()}
+	var offset int64 = 0
+	for level := 62; level >= 0; level-- {
+		if f.size&(int64(1)<<uint(level)) == 0 {
+			continue
+		}
+		hash, ok := m.subtree(level, offset>>uint(level))
+		if !ok {
+			log.Panicf("Merkle tree for shard group %d is missing nodes", m.shardGroup)
+		}
+		f.levels = append(f.levels, level)
+		f.hashes = append(f.hashes, hash)
+		offset += int64(1) << uint(level)
+	}
+	return f
+}
+
+// Append a leaf, queueing it and any subtrees it completes to be persisted
+// (unless m is nil, in which case the tree is only held in memory)
+func (f *merkleFrontier) append(m *merkleStore, leaf []byte) {
+	index := f.size
+	if m != nil {
+		m.queue(0, index, leaf)
+	}
+	f.levels = append(f.levels, 0)
+	f.hashes = append(f.hashes, leaf)
+	for n := len(f.levels); n >= 2 && f.levels[n-1] == f.levels[n-2]; n = len(f.levels) {
+		level := f.levels[n-1] + 1
+		hash := merkleNodeHash(f.hashes[n-2], f.hashes[n-1])
+		index >>= 1
+		if m != nil {
+			m.queue(level, index, hash)
+		}
+		f.levels = append(f.levels[:n-2], level)
+		f.hashes = append(f.hashes[:n-2], hash)
+	}
+	f.size++
+}
+
+func (f *merkleFrontier) root() []byte {
+	n := len(f.hashes)
+	if n == 0 {
+		return merkleEmptyHash()
+	}
+	root := f.hashes[n-1]
+	for i := n - 2; i >= 0; i-- {
+		root = merkleNodeHash(f.hashes[i], root)
+	}
+	return root
+}
+
+func latestTreeHead(db *Database, s *mgo.Session, shardGroup int) (*TreeHead, bool) {
+	var th TreeHead
+	if err := db.getTreeHeadCollection(s).Find(bson.M{"shardgroup": shardGroup}).Sort("-treesize").One(&th); err != nil {
+		if err != mgo.ErrNotFound {
+			log.Panicf("Query returned error %v\n", err)
+		}
+		return nil, false
+	}
+	return &th, true
+}
+
+// Fold up to merkleBatchSize new items of a shard group into its tree,
+// inserting the new nodes together. Returns whether there may be more.
+func (f *merkleFrontier) foldBatch(db *Database, s *mgo.Session, m *merkleStore) bool {
+	c := db.getLogItemCollection(s)
+	iter := c.Find(bson.M{"shardgroup": m.shardGroup, "sequenceid": bson.M{"$gte": f.size}}).Select(bson.M{"sequenceid": 1, "hash": 1}).Sort("sequenceid").Limit(merkleBatchSize).Iter()
+	var item LogItem
+	read := 0
+	more := true
+	for iter.Next(&item) {
+		read++
+		if item.SequenceId < f.size {
+			// A duplicate sequence id; the chain verifier will report this
+			continue
+		}
+		if item.SequenceId > f.size {
+			log.Printf("Merkle tree for shard group %d cannot grow past sequence id %d: next item is %d\n", m.shardGroup, f.size-1, item.SequenceId)
+			more = false
+			break
+		}
+		f.append(m, item.merkleLeaf())
+	}
+	if err := iter.Close(); err != nil {
+		log.Panicf("Error while iterating: %v\n", err)
+	}
+	m.flush()
+	return more && read == merkleBatchSize
+}
+
+// Fold all new items of a shard group into its tree, a batch at a time for
+// as long as we hold its lease, and publish a new tree head if the tree
+// grew. Returns the latest tree head.
+func (f *merkleFrontier) fold(db *Database, s *mgo.Session, m *merkleStore) *TreeHead {
+	start := f.size
+	for f.foldBatch(db, s, m) && holdsLease(db, s, m.shardGroup) {
+	}
+
+	if latest, ok := latestTreeHead(db, s, m.shardGroup); f.size == start && ok && latest.TreeSize == f.size {
+		return latest
+	}
+	th := TreeHead{ShardGroup: m.shardGroup, TreeSize: f.size, RootHash: hex.EncodeToString(f.root()), Time: time.Now()}
+	if err := db.getTreeHeadCollection(s).Insert(&th); err != nil && !mgo.IsDup(err) {
+		log.Panicf("Could not insert tree head %v\n", err)
+	}
+	return &th
+}
+
+func merkleThreadRun(db *Database) {
+	frontiers := make(map[int]*merkleFrontier)
+	for {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("panic caught in merkle thread: %+v", err)
+					// Reload the frontiers from the database next time around
+					frontiers = make(map[int]*merkleFrontier)
+				}
+			}()
+			sessionCopy := db.mongoSession.Copy()
+			defer sessionCopy.Close()
+			for _, sg := range db.shardGroups(sessionCopy) {
+				if !holdsLease(db, sessionCopy, sg) {
+					// The owner builds the tree, so reload if we take over
+					delete(frontiers, sg)
+					continue
+				}
+				m := newMerkleStore(db, sessionCopy, sg)
+				f, ok := frontiers[sg]
+				if !ok {
+					f = loadMerkleFrontier(m)
+					frontiers[sg] = f
+				}
+				th := f.fold(db, sessionCopy, m)
+				if checkpointSigner != nil {
+					emitCheckpoint(db, sessionCopy, th)
+				}
+			}
+		}()
+		time.Sleep(time.Duration(merkleInterval) * time.Second)
+	}
+}
+
+func startMerkleThread(db *Database) {
+	if merkleInterval <= 0 {
+		return
+	}
+	log.Printf("Starting merkle thread every %d seconds\n", merkleInterval)
+	go merkleThreadRun(db)
+}
+
+// A treeHasher can compute MTH(D[start:end]) for the subtrees used by the
+// RFC 6962 algorithms
+type treeHasher interface {
+	treeHash(start int64, end int64) ([]byte, bool)
+}
+
+// PATH(m, D[start:end]) from RFC 6962 section 2.1.1, with m an absolute leaf
+// index. The path runs from the leaf towards the root.
+func merkleAuditPath(t treeHasher, m int64, start int64, end int64) ([][]byte, bool) {
+	n := end - start
+	if n <= 1 {
+		return [][]byte{}, true
+	}
+	k := largestPowerOfTwoBelow(n)
+	var path [][]byte
+	var sibling []byte
+	var ok bool
+	if m < start+k {
+		if path, ok = merkleAuditPath(t, m, start, start+k); !ok {
+			return nil, false
+		}
+		sibling, ok = t.treeHash(start+k, end)
+	} else {
+		if path, ok = merkleAuditPath(t, m, start+k, end); !ok {
+			return nil, false
+		}
+		sibling, ok = t.treeHash(start, start+k)
+	}
+	if !ok {
+		return nil, false
+	}
+	return append(path, sibling), true
+}
+
+// Verify an audit path for a leaf hash at a given index against the root of
+// a tree of a given size, as per RFC 9162 section 2.1.3.2
+func verifyInclusionProof(leaf []byte, index int64, size int64, path [][]byte, root []byte) bool {
+	if index < 0 || index >= size {
+		return false
+	}
+	fn := index
+	sn := size - 1
+	r := leaf
+	for _, p := range path {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = merkleNodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = merkleNodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+func findTreeHead(db *Database, s *mgo.Session, shardGroup int, treeSize int64) (*TreeHead, bool) {
+	if treeSize < 0 {
+		return latestTreeHead(db, s, shardGroup)
+	}
+	var th TreeHead
+	if err := db.getTreeHeadCollection(s).Find(bson.M{"shardgroup": shardGroup, "treesize": treeSize}).One(&th); err != nil {
+		if err != mgo.ErrNotFound {
+			log.Panicf("Query returned error %v\n", err)
+		}
+		return nil, false
+	}
+	return &th, true
+}
+
+func encodeMerkleHashes(hashes [][]byte) []string {
+	s := make([]string, len(hashes))
+	for i, h := range hashes {
+		s[i] = hex.EncodeToString(h)
+	}
+	return s
+}
+
+type InclusionProof struct {
+	ShardGroup int      `json:"shard_group"`
+	SequenceId int64    `json:"sequence_id"`
+	TreeSize   int64    `json:"tree_size"`
+	Hash       string   `json:"hash"`
+	LeafHash   string   `json:"leaf_hash"`
+	AuditPath  []string `json:"audit_path"`
+	TreeHead   TreeHead `json:"tree_head"`
+	Verified   bool     `json:"verified"`
+}
+
+var (
+	errNoTreeHead    = errors.New("No such tree head")
+	errNotYetInTree  = errors.New("Sequence id is not yet included in the tree head")
+	errNoSuchLogItem = errors.New("No such log item")
+)
+
+// Build a proof that the item with a given sequence id is included in a
+// published tree head (a negative treeSize meaning the latest)
+func merkleInclusionProof(db *Database, shardGroup int, sequenceId int64, treeSize int64) (*InclusionProof, error) {
+	sessionCopy := db.mongoSession.Copy()
+	defer sessionCopy.Close()
+
+	th, ok := findTreeHead(db, sessionCopy, shardGroup, treeSize)
+	if !ok {
+		return nil, errNoTreeHead
+	}
+	if sequenceId >= th.TreeSize {
+		return nil, errNotYetInTree
+	}
+
+	var item LogItem
+	if err := db.getLogItemCollection(sessionCopy).Find(bson.M{"shardgroup": shardGroup, "sequenceid": sequenceId}).One(&item); err != nil {
+		if err != mgo.ErrNotFound {
+			log.Panicf("Query returned error %v\n", err)
+		}
+		return nil, errNoSuchLogItem
+	}
+
+	m := newMerkleStore(db, sessionCopy, shardGroup)
+	leaf, ok := m.subtree(0, sequenceId)
+	if !ok {
+		log.Panicf("Merkle tree for shard group %d is missing leaf %d", shardGroup, sequenceId)
+	}
+	path, ok := merkleAuditPath(m, sequenceId, 0, th.TreeSize)
+	if !ok {
+		log.Panicf("Merkle tree for shard group %d is missing nodes", shardGroup)
+	}
+
+	return &InclusionProof{
+		ShardGroup: shardGroup,
+		SequenceId: sequenceId,
+		TreeSize:   th.TreeSize,
+		Hash:       item.Hash,
+		LeafHash:   hex.EncodeToString(leaf),
+		AuditPath:  encodeMerkleHashes(path),
+		TreeHead:   *th,
+		// The proof is against the leaf as folded; the item is only verified
+		// if it still matches that leaf and the path leads to the root
+		Verified: bytes.Equal(leaf, item.merkleLeaf()) && item.checkHash() == nil &&
+			verifyInclusionProof(leaf, sequenceId, th.TreeSize, path, decodeMerkleHash(th.RootHash)),
+	}, nil
+}
+
+// A Receipt is returned on creation of a log item and may later be redeemed
+// for an InclusionProof once the item has been folded into a tree head
+type Receipt struct {
+	ShardGroup int    `json:"shard_group"`
+	SequenceId int64  `json:"sequence_id"`
+	Hash       string `json:"hash"`
+	ProofUrl   string `json:"proof_url"`
+}
+
+func (l *LogItem) receipt() *Receipt {
+	return &Receipt{
+		ShardGroup: l.ShardGroup,
+		SequenceId: l.SequenceId,
+		Hash:       l.Hash,
+		ProofUrl:   fmt.Sprintf("/logitem/proof?shard_group=%d&sequence_id=%d", l.ShardGroup, l.SequenceId),
+	}
+}
+
+// SUBPROOF(m, D[start:end], b) from RFC 6962 section 2.1.2, with m relative
+// to start
+func merkleSubProof(t treeHasher, m int64, start int64, end int64, b bool) ([][]byte, bool) {
+	n := end - start
+	if m == n {
+		if b {
+			return [][]byte{}, true
+		}
+		h, ok := t.treeHash(start, end)
+		if !ok {
+			return nil, false
+		}
+		return [][]byte{h}, true
+	}
+	k := largestPowerOfTwoBelow(n)
+	var proof [][]byte
+	var sibling []byte
+	var ok bool
+	if m <= k {
+		if proof, ok = merkleSubProof(t, m, start, start+k, b); !ok {
+			return nil, false
+		}
+		sibling, ok = t.treeHash(start+k, end)
+	} else {
+		if proof, ok = merkleSubProof(t, m-k, start+k, end, false); !ok {
+			return nil, false
+		}
+		sibling, ok = t.treeHash(start, start+k)
+	}
+	if !ok {
+		return nil, false
+	}
+	return append(proof, sibling), true
+}
+
+// PROOF(m, D[n]) from RFC 6962 section 2.1.2
+func merkleConsistencyPath(t treeHasher, first int64, second int64) ([][]byte, bool) {
+	if first == 0 || first == second {
+		return [][]byte{}, true
+	}
+	return merkleSubProof(t, first, 0, second, true)
+}
+
+// Verify a consistency proof between two tree heads, as per RFC 9162
+// section 2.1.4.2
+func verifyConsistencyProof(first int64, second int64, proof [][]byte, firstRoot []byte, secondRoot []byte) bool {
+	if first < 0 || first > second {
+		return false
+	}
+	if first == second {
+		return len(proof) == 0 && bytes.Equal(firstRoot, secondRoot)
+	}
+	if first == 0 {
+		// The empty tree is consistent with every tree
+		return len(proof) == 0 && bytes.Equal(firstRoot, merkleEmptyHash())
+	}
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+	if len(proof) == 0 {
+		return false
+	}
+	fn := first - 1
+	sn := second - 1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr := proof[0]
+	sr := proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = merkleNodeHash(c, fr)
+			sr = merkleNodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = merkleNodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, firstRoot) && bytes.Equal(sr, secondRoot)
+}
+
+type ConsistencyProof struct {
+	ShardGroup int      `json:"shard_group"`
+	First      TreeHead `json:"first"`
+	Second     TreeHead `json:"second"`
+	Proof      []string `json:"proof"`
+	Verified   bool     `json:"verified"`
+}
+
+var errBadTreeSizes = errors.New("First tree size must not exceed second tree size")
+
+// Build a proof that the published tree head of size 'first' is a prefix of
+// the published tree head of size 'second' (a negative second meaning the
+// latest)
+func merkleConsistencyProof(db *Database, shardGroup int, first int64, second int64) (*ConsistencyProof, error) {
+	sessionCopy := db.mongoSession.Copy()
+	defer sessionCopy.Close()
+
+	fth, ok := findTreeHead(db, sessionCopy, shardGroup, first)
+	if !ok {
+		return nil, errNoTreeHead
+	}
+	sth, ok := findTreeHead(db, sessionCopy, shardGroup, second)
+	if !ok {
+		return nil, errNoTreeHead
+	}
+	if fth.TreeSize > sth.TreeSize {
+		return nil, errBadTreeSizes
+	}
+
+	m := newMerkleStore(db, sessionCopy, shardGroup)
+	proof, ok := merkleConsistencyPath(m, fth.TreeSize, sth.TreeSize)
+	if !ok {
+		log.Panicf("Merkle tree for shard group %d is missing nodes", shardGroup)
+	}
+
+	return &ConsistencyProof{
+		ShardGroup: shardGroup,
+		First:      *fth,
+		Second:     *sth,
+		Proof:      encodeMerkleHashes(proof),
+		Verified:   verifyConsistencyProof(fth.TreeSize, sth.TreeSize, proof, decodeMerkleHash(fth.RootHash), decodeMerkleHash(sth.RootHash)),
+	}, nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// The leaves and roots of the RFC 6962 test tree used by Certificate
+// Transparency
+var rfc6962Leaves = [][]byte{
+	{},
+	{0x00},
+	{0x10},
+	{0x20, 0x21},
+	{0x30, 0x31},
+	{0x40, 0x41, 0x42, 0x43},
+	{0x50, 0x51, 0x52, 0x53, 0x54, 0x55, 0x56, 0x57},
+	{0x60, 0x61, 0x62, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69, 0x6a, 0x6b, 0x6c, 0x6d, 0x6e, 0x6f},
+}
+
+var rfc6962Roots = []string{
+	"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+	"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+	"aeb6bcfe274b70a14fb067a5e5578264db0fa9b51af5e0ba159158f329e06e77",
+	"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+	"4e3bbb1f7b478dcfe71fb631631519a3bca12c9aefca1612bfce4c13a86264d4",
+	"76e67dadbcdf1e10e1b74ddc608abd2f98dfb16fbce75277b5232a127f2087ef",
+	"ddb89be403809e325750d3d263cd78929c2942b7942a34b77e122c9594a74c8c",
+	"5dc9da79a70659a9ad559cb701ded9a2ab9d823aad2f4960cfe370eff4604328",
+}
+
+// A treeHasher over leaf hashes held in memory
+type memoryTree [][]byte
+
+func (t memoryTree) treeHash(start int64, end int64) ([]byte, bool) {
+	switch n := end - start; n {
+	case 0:
+		return merkleEmptyHash(), true
+	case 1:
+		return t[start], true
+	default:
+		k := largestPowerOfTwoBelow(n)
+		left, _ := t.treeHash(start, start+k)
+		right, _ := t.treeHash(start+k, end)
+		return merkleNodeHash(left, right), true
+	}
+}
+
+func rfc6962Tree() memoryTree {
+	var t memoryTree
+	for _, leaf := range rfc6962Leaves {
+		t = append(t, merkleLeafHash(leaf))
+	}
+	return t
+}
+
+func TestMerkleFrontierRoots(t *testing.T) {
+	var f merkleFrontier
+	tree := rfc6962Tree()
+	for size, want := range rfc6962Roots {
+		if got := hex.EncodeToString(f.root()); got != want {
+			t.Errorf("root of %d leaves = %s, want %s", size, got, want)
+		}
+		if got, _ := tree.treeHash(0, int64(size)); hex.EncodeToString(got) != want {
+			t.Errorf("MTH of %d leaves = %x, want %s", size, got, want)
+		}
+		if size < len(tree) {
+			f.append(nil, tree[size])
+		}
+	}
+	if f.size != int64(len(tree)) {
+		t.Errorf("frontier size = %d, want %d", f.size, len(tree))
+	}
+}
+
+func TestLargestPowerOfTwoBelow(t *testing.T) {
+	for _, tc := range []struct {
+		n, want int64
+	}{
+		{2, 1}, {3, 2}, {4, 2}, {5, 4}, {8, 4}, {9, 8}, {1 << 40, 1 << 39}, {1<<40 + 1, 1 << 40},
+	} {
+		if got := largestPowerOfTwoBelow(tc.n); got != tc.want {
+			t.Errorf("largestPowerOfTwoBelow(%d) = %d, want %d", tc.n, got, tc.want)
+		}
+	}
+}
+
+func decodeHashes(t *testing.T, hashes []string) [][]byte {
+	result := [][]byte{}
+	for _, h := range hashes {
+		b, err := hex.DecodeString(h)
+		if err != nil {
+			t.Fatalf("bad test hash %s", h)
+		}
+		result = append(result, b)
+	}
+	return result
+}
+
+func TestMerkleInclusion(t *testing.T) {
+	tree := rfc6962Tree()
+	for _, tc := range []struct {
+		index, size int64
+		path        []string
+	}{
+		{0, 1, nil},
+		{0, 8, []string{
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		}},
+		{5, 8, []string{
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+		{2, 3, []string{
+			"fac54203e7cc696cf0dfcb42c92a1d9dbaf70ad9e621f4bd8d98662f00e3c125",
+		}},
+		{1, 5, []string{
+			"6e340b9cffb37a989ca544e6bb780a2c78901d3fb33738768511a30617afa01d",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		}},
+	} {
+		want := decodeHashes(t, tc.path)
+		got, ok := merkleAuditPath(tree, tc.index, 0, tc.size)
+		if !ok || hex.EncodeToString(bytes.Join(got, nil)) != hex.EncodeToString(bytes.Join(want, nil)) {
+			t.Errorf("audit path for leaf %d of %d = %x, want %x", tc.index, tc.size, got, want)
+		}
+		root := decodeHashes(t, []string{rfc6962Roots[tc.size]})[0]
+		if !verifyInclusionProof(tree[tc.index], tc.index, tc.size, want, root) {
+			t.Errorf("inclusion proof for leaf %d of %d does not verify", tc.index, tc.size)
+		}
+	}
+}
+
+func TestMerkleInclusionRejects(t *testing.T) {
+	tree := rfc6962Tree()
+	root := decodeHashes(t, []string{rfc6962Roots[8]})[0]
+	path, _ := merkleAuditPath(tree, 5, 0, 8)
+	for _, tc := range []struct {
+		name        string
+		leaf        []byte
+		index, size int64
+		path        [][]byte
+		root        []byte
+	}{
+		{"wrong leaf", tree[4], 5, 8, path, root},
+		{"wrong index", tree[5], 4, 8, path, root},
+		{"wrong size", tree[5], 5, 6, path, root},
+		{"wrong root", tree[5], 5, 8, path, tree[0]},
+		{"short path", tree[5], 5, 8, path[:2], root},
+		{"long path", tree[5], 5, 8, append(append([][]byte{}, path...), tree[0]), root},
+		{"index beyond size", tree[5], 8, 8, path, root},
+		{"negative index", tree[5], -1, 8, path, root},
+	} {
+		if verifyInclusionProof(tc.leaf, tc.index, tc.size, tc.path, tc.root) {
+			t.Errorf("%s: inclusion proof verifies", tc.name)
+		}
+	}
+}
+
+// Every proof in a larger tree should verify
+func TestMerkleInclusionAllSizes(t *testing.T) {
+	var tree memoryTree
+	for i := 0; i < 40; i++ {
+		tree = append(tree, merkleLeafHash([]byte{byte(i)}))
+	}
+	for size := int64(1); size <= 40; size++ {
+		root, _ := tree.treeHash(0, size)
+		for index := int64(0); index < size; index++ {
+			path, ok := merkleAuditPath(tree, index, 0, size)
+			if !ok || !verifyInclusionProof(tree[index], index, size, path, root) {
+				t.Errorf("inclusion proof for leaf %d of %d does not verify", index, size)
+			}
+		}
+	}
+}
+
+func TestMerkleConsistency(t *testing.T) {
+	tree := rfc6962Tree()
+	for _, tc := range []struct {
+		first, second int64
+		proof         []string
+	}{
+		{1, 1, nil},
+		{1, 8, []string{
+			"96a296d224f285c67bee93c30f8a309157f0daa35dc5b87e410b78630a09cfc7",
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"6b47aaf29ee3c2af9af889bc1fb9254dabd31177f16232dd6aab035ca39bf6e4",
+		}},
+		{6, 8, []string{
+			"0ebc5d3437fbe2db158b9f126a1d118e308181031d0a949f8dededebc558ef6a",
+			"ca854ea128ed050b41b35ffc1b87b8eb2bde461e9e3b5596ece6b9d5975a0ae0",
+			"d37ee418976dd95753c1c73862b9398fa2a2cf9b4ff0fdfe8b30cd95209614b7",
+		}},
+		{2, 5, []string{
+			"5f083f0a1a33ca076a95279832580db3e0ef4584bdff1f54c8a360f50de3031e",
+			"bc1a0643b12e4d2d7c77918f44e0f4f79a838b6cf9ec5b5c283e1f4d88599e6b",
+		}},
+	} {
+		want := decodeHashes(t, tc.proof)
+		got, ok := merkleConsistencyPath(tree, tc.first, tc.second)
+		if !ok || hex.EncodeToString(bytes.Join(got, nil)) != hex.EncodeToString(bytes.Join(want, nil)) {
+			t.Errorf("consistency proof from %d to %d = %x, want %x", tc.first, tc.second, got, want)
+		}
+		roots := decodeHashes(t, []string{rfc6962Roots[tc.first], rfc6962Roots[tc.second]})
+		if !verifyConsistencyProof(tc.first, tc.second, want, roots[0], roots[1]) {
+			t.Errorf("consistency proof from %d to %d does not verify", tc.first, tc.second)
+		}
+	}
+}
+
+func TestMerkleConsistencyRejects(t *testing.T) {
+	tree := rfc6962Tree()
+	roots := decodeHashes(t, rfc6962Roots)
+	proof, _ := merkleConsistencyPath(tree, 6, 8)
+	for _, tc := range []struct {
+		name                  string
+		first, second         int64
+		proof                 [][]byte
+		firstRoot, secondRoot []byte
+	}{
+		{"wrong first root", 6, 8, proof, roots[5], roots[8]},
+		{"wrong second root", 6, 8, proof, roots[6], roots[7]},
+		{"wrong first size", 5, 8, proof, roots[6], roots[8]},
+		{"short proof", 6, 8, proof[:2], roots[6], roots[8]},
+		{"long proof", 6, 8, append(append([][]byte{}, proof...), roots[0]), roots[6], roots[8]},
+		{"first beyond second", 8, 6, proof, roots[8], roots[6]},
+		{"empty first tree with a root", 0, 8, nil, roots[1], roots[8]},
+		{"differing equal trees", 8, 8, nil, roots[7], roots[8]},
+	} {
+		if verifyConsistencyProof(tc.first, tc.second, tc.proof, tc.firstRoot, tc.secondRoot) {
+			t.Errorf("%s: consistency proof verifies", tc.name)
+		}
+	}
+}
+
+func TestMerkleConsistencyEmpty(t *testing.T) {
+	roots := decodeHashes(t, rfc6962Roots)
+	if !verifyConsistencyProof(0, 8, nil, roots[0], roots[8]) {
+		t.Error("the empty tree is not consistent with a larger tree")
+	}
+}
+
+// Every proof between two sizes of a larger tree should verify
+func TestMerkleConsistencyAllSizes(t *testing.T) {
+	var tree memoryTree
+	for i := 0; i < 40; i++ {
+		tree = append(tree, merkleLeafHash([]byte{byte(i)}))
+	}
+	for second := int64(1); second <= 40; second++ {
+		secondRoot, _ := tree.treeHash(0, second)
+		for first := int64(1); first <= second; first++ {
+			firstRoot, _ := tree.treeHash(0, first)
+			proof, ok := merkleConsistencyPath(tree, first, second)
+			if !ok || !verifyConsistencyProof(first, second, proof, firstRoot, secondRoot) {
+				t.Errorf("consistency proof from %d to %d does not verify", first, second)
+			}
+		}
+	}
+}
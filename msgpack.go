@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+/*
+ * Just enough MessagePack for the Forward protocol. Values decode to nil,
+ * bool, int64 (or uint64 where too large), float64, string, []byte,
+ * []interface{}, map[string]interface{} (with any non-string keys
+ * formatted as strings) or msgpackExt.
+ */
+
+const (
+	msgpackMaxLen   = 64 * 1024 * 1024 // Longest str, bin or ext
+	msgpackMaxItems = 1024 * 1024      // Most entries in an array or map
+	msgpackMaxDepth = 64
+)
+
+type msgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+type msgpackDecoder struct {
+	r     *bufio.Reader
+	depth int
+}
+
+func newMsgpackDecoder(r io.Reader) *msgpackDecoder {
+	if br, ok := r.(*bufio.Reader); ok {
+		return &msgpackDecoder{r: br}
+	}
+	return &msgpackDecoder{r: bufio.NewReader(r)}
+}
+
+// Lengths come from the sender, so we never allocate more up front than
+// msgpackInitialCap, and grow only as data actually arrives
+const msgpackInitialCap = 1024
+
+func (d *msgpackDecoder) readN(n int) ([]byte, error) {
+	if n <= msgpackInitialCap {
+		b := make([]byte, n)
+		_, err := io.ReadFull(d.r, b)
+		return b, err
+	}
+	var buf bytes.Buffer
+	buf.Grow(msgpackInitialCap)
+	if _, err := io.CopyN(&buf, d.r, int64(n)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func msgpackCap(n int) int {
+	if n > msgpackInitialCap {
+		return msgpackInitialCap
+	}
+	return n
+}
+
+// Read an n byte big endian unsigned integer
+func (d *msgpackDecoder) readUint(n int) (uint64, error) {
+	b, err := d.readN(n)
+	if err != nil {
+		return 0, err
+	}
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v, nil
+}
+
+func (d *msgpackDecoder) readLen(n int, max uint64) (int, error) {
+	v, err := d.readUint(n)
+	if err != nil {
+		return 0, err
+	}
+	if v > max {
+		return 0, errors.New("msgpack value too long")
+	}
+	return int(v), nil
+}
+
+func (d *msgpackDecoder) decode() (interface{}, error) {
+	c, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c >= 0x80 && c <= 0x8f:
+		return d.decodeMap(int(c & 0x0f))
+	case c >= 0x90 && c <= 0x9f:
+		return d.decodeArray(int(c & 0x0f))
+	case c >= 0xa0 && c <= 0xbf:
+		b, err := d.readN(int(c & 0x1f))
+		return string(b), err
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readLen(1<<(c-0xc4), msgpackMaxLen)
+		if err != nil {
+			return nil, err
+		}
+		return d.readN(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.readLen(1<<(c-0xc7), msgpackMaxLen)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(n)
+	case 0xca:
+		v, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(v))), err
+	case 0xcb:
+		v, err := d.readUint(8)
+		return math.Float64frombits(v), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		v, err := d.readUint(1 << (c - 0xcc))
+		if v > math.MaxInt64 {
+			return v, err
+		}
+		return int64(v), err
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		n := 1 << (c - 0xd0)
+		v, err := d.readUint(n)
+		// Sign extend
+		shift := uint(64 - 8*n)
+		return int64(v<<shift) >> shift, err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (c - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readLen(1<<(c-0xd9), msgpackMaxLen)
+		if err != nil {
+			return nil, err
+		}
+		b, err := d.readN(n)
+		return string(b), err
+	case 0xdc, 0xdd:
+		n, err := d.readLen(2<<(c-0xdc), msgpackMaxItems)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n)
+	case 0xde, 0xdf:
+		n, err := d.readLen(2<<(c-0xde), msgpackMaxItems)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n)
+	}
+	return nil, fmt.Errorf("unknown msgpack type 0x%02x", c)
+}
+
+func (d *msgpackDecoder) decodeExt(n int) (interface{}, error) {
+	t, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	b, err := d.readN(n)
+	return msgpackExt{Type: int8(t), Data: b}, err
+}
+
+func (d *msgpackDecoder) decodeArray(n int) (interface{}, error) {
+	if d.depth++; d.depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack nested too deeply")
+	}
+	defer func() { d.depth-- }()
+	a := make([]interface{}, 0, msgpackCap(n))
+	for i := 0; i < n; i++ {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (interface{}, error) {
+	if d.depth++; d.depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack nested too deeply")
+	}
+	defer func() { d.depth-- }()
+	m := make(map[string]interface{}, msgpackCap(n))
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		switch t := k.(type) {
+		case string:
+			m[t] = v
+		case []byte:
+			m[string(t)] = v
+		default:
+			m[fmt.Sprint(t)] = v
+		}
+	}
+	return m, nil
+}
+
+// Append a msgpack str
+func msgpackAppendString(b []byte, s string) []byte {
+	n := len(s)
+	switch {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n < 1<<8:
+		b = append(b, 0xd9, byte(n))
+	case n < 1<<16:
+		b = append(b, 0xda, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(n))
+	default:
+		b = append(b, 0xdb, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(b[len(b)-4:], uint32(n))
+	}
+	return append(b, s...)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func decodeMsgpackHex(t *testing.T, s string) (interface{}, error) {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		t.Fatalf("bad test data %s", s)
+	}
+	return newMsgpackDecoder(bytes.NewReader(b)).decode()
+}
+
+func TestMsgpackDecode(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want interface{}
+	}{
+		{"00", int64(0)},
+		{"7f", int64(127)},
+		{"ff", int64(-1)},
+		{"e0", int64(-32)},
+		{"c0", nil},
+		{"c2", false},
+		{"c3", true},
+		{"cc ff", int64(255)},
+		{"cd 01 00", int64(256)},
+		{"ce ff ff ff ff", int64(math.MaxUint32)},
+		{"cf 7f ff ff ff ff ff ff ff", int64(math.MaxInt64)},
+		{"cf ff ff ff ff ff ff ff ff", uint64(math.MaxUint64)},
+		{"d0 80", int64(-128)},
+		{"d1 80 00", int64(-32768)},
+		{"d2 ff ff ff fe", int64(-2)},
+		{"d3 80 00 00 00 00 00 00 00", int64(math.MinInt64)},
+		{"ca 3f c0 00 00", float64(1.5)},
+		{"cb 3f f8 00 00 00 00 00 00", float64(1.5)},
+		{"a0", ""},
+		{"a3 61 62 63", "abc"},
+		{"d9 03 61 62 63", "abc"},
+		{"da 00 03 61 62 63", "abc"},
+		{"db 00 00 00 03 61 62 63", "abc"},
+		{"c4 02 01 02", []byte{1, 2}},
+		{"c5 00 00", []byte{}},
+		{"c6 00 00 00 01 ff", []byte{0xff}},
+		{"d4 00 01", msgpackExt{Type: 0, Data: []byte{1}}},
+		{"d7 ff 00 00 00 01 00 00 00 02", msgpackExt{Type: -1, Data: []byte{0, 0, 0, 1, 0, 0, 0, 2}}},
+		{"c7 03 05 01 02 03", msgpackExt{Type: 5, Data: []byte{1, 2, 3}}},
+		{"90", []interface{}{}},
+		{"92 01 a1 78", []interface{}{int64(1), "x"}},
+		{"dc 00 01 c0", []interface{}{nil}},
+		{"dd 00 00 00 01 c3", []interface{}{true}},
+		{"80", map[string]interface{}{}},
+		{"82 a1 61 01 a1 62 92 02 03", map[string]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"81 c4 01 6b 01", map[string]interface{}{"k": int64(1)}},
+		{"81 07 01", map[string]interface{}{"7": int64(1)}},
+		{"de 00 01 a1 61 c0", map[string]interface{}{"a": nil}},
+	} {
+		got, err := decodeMsgpackHex(t, tc.in)
+		if err != nil {
+			t.Errorf("%s: %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v, want %#v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestMsgpackMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   string
+	}{
+		{"empty", ""},
+		{"unknown type", "c1"},
+		{"truncated uint16", "cd 01"},
+		{"truncated int64", "d3 00 00"},
+		{"truncated float64", "cb 3f f8"},
+		{"truncated fixstr", "a3 61 62"},
+		{"truncated str8 length", "d9"},
+		{"truncated str32", "db 00 00 00 05 61"},
+		{"truncated bin", "c4 02 01"},
+		{"truncated fixext", "d5 01 00"},
+		{"truncated ext type", "c7 01"},
+		{"truncated array", "92 01"},
+		{"truncated map value", "81 a1 61"},
+		{"truncated nested", "91 91 91"},
+		// Lengths far beyond the data, which must fail without allocating them
+		{"huge str", "db 03 ff ff ff 61"},
+		{"huge bin", "c6 03 ff ff ff 61"},
+		{"huge ext", "c9 03 ff ff ff 01 61"},
+		{"huge array", "dd 00 0f ff ff 01"},
+		{"huge map", "df 00 0f ff ff 01"},
+		// Lengths beyond the limits
+		{"str too long", "db 04 00 00 01 61"},
+		{"array too long", "dd 00 10 00 01 01"},
+		{"map too long", "df 00 10 00 01 01"},
+	} {
+		if got, err := decodeMsgpackHex(t, tc.in); err == nil {
+			t.Errorf("%s: accepted as %#v", tc.name, got)
+		}
+	}
+}
+
+func TestMsgpackDepth(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		open  string
+		depth int
+		ok    bool
+	}{
+		{"arrays at the limit", "91", msgpackMaxDepth, true},
+		{"arrays too deep", "91", msgpackMaxDepth + 1, false},
+		{"maps at the limit", "81 a1 61", msgpackMaxDepth, true},
+		{"maps too deep", "81 a1 61", msgpackMaxDepth + 1, false},
+		{"arrays far too deep", "91", 1000000, false},
+	} {
+		in := strings.Repeat(tc.open, tc.depth) + "c0"
+		if _, err := decodeMsgpackHex(t, in); (err == nil) != tc.ok {
+			t.Errorf("%s: error %v", tc.name, err)
+		}
+	}
+}
+
+// Large values are read whole, however they arrive
+func TestMsgpackLargeValues(t *testing.T) {
+	s := strings.Repeat("x", 100000)
+	got, err := newMsgpackDecoder(bytes.NewReader(msgpackAppendString(nil, s))).decode()
+	if err != nil || got != s {
+		t.Errorf("long string: %v", err)
+	}
+}
+
+func TestMsgpackAppendString(t *testing.T) {
+	for _, n := range []int{0, 31, 32, 255, 256, 65535, 65536} {
+		s := strings.Repeat("a", n)
+		b := msgpackAppendString(nil, s)
+		got, err := newMsgpackDecoder(bytes.NewReader(b)).decode()
+		if err != nil || got != s {
+			t.Errorf("string of %d bytes does not round trip: %v", n, err)
+		}
+	}
+	if got := hex.EncodeToString(msgpackAppendString(nil, "ack")); got != "a361636b" {
+		t.Errorf("ack encoded as %s", got)
+	}
+}
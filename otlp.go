@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+ * OTLP/HTTP log export, i.e. POST /v1/logs with an ExportLogsServiceRequest
+ * encoded as either protobuf (application/x-protobuf) or OTLP's JSON
+ * mapping (application/json), optionally gzip compressed. This is what the
+ * OpenTelemetry Collector's otlphttp exporter sends.
+ *
+ * Each log record becomes a LogItem:
+ *
+ *   resource host.name -> hostname, service.name -> app_name,
+ *   service.instance.id -> instance_id, process.pid -> pid,
+ *   time_unix_nano (or else observed_time_unix_nano) -> timestamp,
+ *   severity_number (or else severity_text) -> level, body -> message,
+ *   trace_id -> trace_id, span_id -> span_id
+ *
+ * Any other resource attributes, the record's attributes (which take
+ * precedence), the instrumentation scope's name as otel.scope.name and
+ * the record's event_name as event.name are kept as attributes.
+ */
+
+const otlpMaxBodyLen = 16 * 1024 * 1024
+
+// Deepest nesting of arrays and kvlists we decode, well short of
+// exhausting the stack
+const otlpMaxDepth = 64
+
+var errOtlpTooDeep = errors.New("OTLP value nested too deeply")
+
+// Slogger levels for OpenTelemetry severity numbers 1 to 24, in fours
+var otlpSeverityLevels = []string{"debug", "debug", "info", "warn", "err", "crit"}
+
+// An integer which OTLP/JSON may send as either a number or a string
+type otlpInt int64
+
+func (i *otlpInt) UnmarshalJSON(b []byte) error {
+	v, err := strconv.ParseInt(string(bytes.Trim(b, `"`)), 10, 64)
+	if err != nil {
+		return err
+	}
+	*i = otlpInt(v)
+	return nil
+}
+
+// A trace or span id, which OTLP/JSON sends as hex
+type otlpId []byte
+
+func (id *otlpId) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	*id = v
+	return nil
+}
+
+// The string form, or "" if the id is absent or all zeroes
+func (id otlpId) String() string {
+	for _, c := range id {
+		if c != 0 {
+			return hex.EncodeToString(id)
+		}
+	}
+	return ""
+}
+
+type otlpAnyValue struct {
+	StringValue *string          `json:"stringValue"`
+	BoolValue   *bool            `json:"boolValue"`
+	IntValue    *otlpInt         `json:"intValue"`
+	DoubleValue *float64         `json:"doubleValue"`
+	ArrayValue  *otlpArrayValue  `json:"arrayValue"`
+	KvlistValue *otlpKvlistValue `json:"kvlistValue"`
+	BytesValue  []byte           `json:"bytesValue"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+type otlpKvlistValue struct {
+	Values []otlpKeyValue `json:"values"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         otlpInt        `json:"timeUnixNano"`
+	ObservedTimeUnixNano otlpInt        `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber"`
+	SeverityText         string         `json:"severityText"`
+	Body                 otlpAnyValue   `json:"body"`
+	Attributes           []otlpKeyValue `json:"attributes"`
+	TraceId              otlpId         `json:"traceId"`
+	SpanId               otlpId         `json:"spanId"`
+	EventName            string         `json:"eventName"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope       `json:"scope"`
+	LogRecords []otlpLogRecord `json:"logRecords"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+func otlpDecodeAnyValue(p *protoReader, depth int) otlpAnyValue {
+	var v otlpAnyValue
+	if depth > otlpMaxDepth {
+		p.fail(errOtlpTooDeep)
+		return v
+	}
+	for p.next() {
+		switch p.field {
+		case 1:
+			s := p.string()
+			v.StringValue = &s
+		case 2:
+			b := p.bool()
+			v.BoolValue = &b
+		case 3:
+			i := otlpInt(p.int64())
+			v.IntValue = &i
+		case 4:
+			d := p.double()
+			v.DoubleValue = &d
+		case 5:
+			a := &otlpArrayValue{}
+			for q := p.message(); q.next(); {
+				if q.field == 1 {
+					a.Values = append(a.Values, otlpDecodeAnyValue(q.message(), depth+1))
+				} else {
+					q.skip()
+				}
+			}
+			v.ArrayValue = a
+		case 6:
+			kvs := &otlpKvlistValue{}
+			for q := p.message(); q.next(); {
+				if q.field == 1 {
+					kvs.Values = append(kvs.Values, otlpDecodeKeyValue(q.message(), depth+1))
+				} else {
+					q.skip()
+				}
+			}
+			v.KvlistValue = kvs
+		case 7:
+			v.BytesValue = append([]byte{}, p.bytes()...)
+		default:
+			p.skip()
+		}
+	}
+	return v
+}
+
+func otlpDecodeKeyValue(p *protoReader, depth int) otlpKeyValue {
+	var kv otlpKeyValue
+	for p.next() {
+		switch p.field {
+		case 1:
+			kv.Key = p.string()
+		case 2:
+			kv.Value = otlpDecodeAnyValue(p.message(), depth)
+		default:
+			p.skip()
+		}
+	}
+	return kv
+}
+
+func otlpDecodeLogRecord(p *protoReader) otlpLogRecord {
+	var l otlpLogRecord
+	for p.next() {
+		switch p.field {
+		case 1:
+			l.TimeUnixNano = otlpInt(p.fixed64())
+		case 2:
+			l.SeverityNumber = int(p.int64())
+		case 3:
+			l.SeverityText = p.string()
+		case 5:
+			l.Body = otlpDecodeAnyValue(p.message(), 0)
+		case 6:
+			l.Attributes = append(l.Attributes, otlpDecodeKeyValue(p.message(), 0))
+		case 9:
+			l.TraceId = append(otlpId{}, p.bytes()...)
+		case 10:
+			l.SpanId = append(otlpId{}, p.bytes()...)
+		case 11:
+			l.ObservedTimeUnixNano = otlpInt(p.fixed64())
+		case 12:
+			l.EventName = p.string()
+		default:
+			p.skip()
+		}
+	}
+	return l
+}
+
+func otlpDecodeScopeLogs(p *protoReader) otlpScopeLogs {
+	var s otlpScopeLogs
+	for p.next() {
+		switch p.field {
+		case 1:
+			for q := p.message(); q.next(); {
+				if q.field == 1 {
+					s.Scope.Name = q.string()
+				} else {
+					q.skip()
+				}
+			}
+		case 2:
+			s.LogRecords = append(s.LogRecords, otlpDecodeLogRecord(p.message()))
+		default:
+			p.skip()
+		}
+	}
+	return s
+}
+
+func otlpDecodeResourceLogs(p *protoReader) otlpResourceLogs {
+	var r otlpResourceLogs
+	for p.next() {
+		switch p.field {
+		case 1:
+			for q := p.message(); q.next(); {
+				if q.field == 1 {
+					r.Resource.Attributes = append(r.Resource.Attributes, otlpDecodeKeyValue(q.message(), 0))
+				} else {
+					q.skip()
+				}
+			}
+		case 2:
+			r.ScopeLogs = append(r.ScopeLogs, otlpDecodeScopeLogs(p.message()))
+		default:
+			p.skip()
+		}
+	}
+	return r
+}
+
+func otlpDecodeLogsRequest(b []byte) (*otlpLogsRequest, error) {
+	req := &otlpLogsRequest{}
+	p := newProtoReader(b)
+	for p.next() {
+		if p.field == 1 {
+			req.ResourceLogs = append(req.ResourceLogs, otlpDecodeResourceLogs(p.message()))
+		} else {
+			p.skip()
+		}
+	}
+	if err := p.error(); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+// The value as a string (base64 for bytes), number, bool, array or map
+func (v otlpAnyValue) value() interface{} {
+	switch {
+	case v.StringValue != nil:
+		return *v.StringValue
+	case v.BoolValue != nil:
+		return *v.BoolValue
+	case v.IntValue != nil:
+		return int64(*v.IntValue)
+	case v.DoubleValue != nil:
+		return *v.DoubleValue
+	case v.ArrayValue != nil:
+		a := make([]interface{}, len(v.ArrayValue.Values))
+		for i, e := range v.ArrayValue.Values {
+			a[i] = e.value()
+		}
+		return a
+	case v.KvlistValue != nil:
+		m := make(map[string]interface{})
+		for _, kv := range v.KvlistValue.Values {
+			m[kv.Key] = kv.Value.value()
+		}
+		return m
+	case v.BytesValue != nil:
+		return base64.StdEncoding.EncodeToString(v.BytesValue)
+	}
+	return nil
+}
+
+func (v otlpAnyValue) String() string {
+	return attributeString(v.value())
+}
+
+func otlpLevel(number int, text string) string {
+	if number >= 1 && number <= 24 {
+		return otlpSeverityLevels[(number-1)/4]
+	}
+	return text
+}
+
+func otlpTime(nanos otlpInt) time.Time {
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(nanos))
+}
+
+// Make log items from the records in an export request
+func (req *otlpLogsRequest) logItems() []*LogItem {
+	var items []*LogItem
+	for _, rl := range req.ResourceLogs {
+		for _, sl := range rl.ScopeLogs {
+			for _, rec := range sl.LogRecords {
+				l := &LogItem{}
+				for _, kv := range rl.Resource.Attributes {
+					switch kv.Key {
+					case "host.name":
+						l.Hostname = kv.Value.String()
+					case "service.name":
+						l.AppName = kv.Value.String()
+					case "service.instance.id":
+						l.InstanceId = kv.Value.String()
+					case "process.pid":
+						if pid, err := strconv.Atoi(kv.Value.String()); err == nil {
+							l.Pid = pid
+						}
+					default:
+						l.setAttribute(kv.Key, kv.Value.String())
+					}
+				}
+				if sl.Scope.Name != "" {
+					l.setAttribute("otel.scope.name", sl.Scope.Name)
+				}
+				if rec.EventName != "" {
+					l.setAttribute("event.name", rec.EventName)
+				}
+				for _, kv := range rec.Attributes {
+					l.setAttribute(kv.Key, kv.Value.String())
+				}
+				l.OriginatorTime = otlpTime(rec.TimeUnixNano)
+				if l.OriginatorTime.IsZero() {
+					l.OriginatorTime = otlpTime(rec.ObservedTimeUnixNano)
+				}
+				l.Level = otlpLevel(rec.SeverityNumber, rec.SeverityText)
+				l.Message = rec.Body.String()
+				l.TraceId = rec.TraceId.String()
+				l.SpanId = rec.SpanId.String()
+				items = append(items, l)
+			}
+		}
+	}
+	return items
+}
+
+func otlpLogs(c *Context, w http.ResponseWriter, r *http.Request) {
+	contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if contentType != "application/x-protobuf" && contentType != "application/json" {
+		r.Body.Close()
+		http.Error(w, "Content-Type must be application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := readRequestBody(r, otlpMaxBodyLen)
+	if err := r.Body.Close(); err != nil {
+		panic(err)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req *otlpLogsRequest
+	if contentType == "application/json" {
+		req = &otlpLogsRequest{}
+		err = json.Unmarshal(body, req)
+	} else {
+		req, err = otlpDecodeLogsRequest(body)
+	}
+	if err != nil {
+		// OTLP requires 400, which tells the exporter not to retry
+		http.Error(w, "Cannot parse export request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	items := req.logItems()
+	for _, l := range items {
+		l.setRequestOrigin(r)
+		l.normalise()
+		l.assignShardGroup(c.listener)
+	}
+	insertLogItems(c.db, items)
+
+	// An empty ExportLogsServiceResponse means every record was accepted
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if contentType == "application/json" {
+		w.Write([]byte("{}"))
+	}
+}
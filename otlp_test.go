@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func otlpTestKeyValue(key string, value []byte) []byte {
+	return protoTestCat(protoTestStringField(1, key), protoTestBytesField(2, value))
+}
+
+func otlpTestString(s string) []byte {
+	return protoTestStringField(1, s)
+}
+
+// An AnyValue of arrays nested depth deep around a string
+func otlpTestNested(depth int) []byte {
+	v := otlpTestString("x")
+	for i := 0; i < depth; i++ {
+		v = protoTestBytesField(5, protoTestBytesField(1, v))
+	}
+	return v
+}
+
+// An export request with a single record
+func otlpTestRequest(record []byte) []byte {
+	scope := protoTestCat(protoTestBytesField(1, otlpTestString("mylib")), protoTestBytesField(2, record))
+	resource := protoTestCat(
+		protoTestBytesField(1, protoTestCat(
+			protoTestBytesField(1, otlpTestKeyValue("host.name", otlpTestString("h1"))),
+			protoTestBytesField(1, otlpTestKeyValue("service.name", otlpTestString("svc"))),
+			protoTestBytesField(1, otlpTestKeyValue("process.pid", protoTestVarintField(3, 42))),
+			protoTestBytesField(1, otlpTestKeyValue("k8s.pod", otlpTestString("p"))),
+		)),
+		protoTestBytesField(2, scope),
+	)
+	return protoTestBytesField(1, resource)
+}
+
+func TestOtlpDecodeLogsRequest(t *testing.T) {
+	initFieldProperties()
+	traceId := []byte{0x5b, 0x8e, 0xff, 0xf7, 0x98, 0x03, 0x81, 0x03, 0xd2, 0x69, 0xb6, 0x33, 0x81, 0x3f, 0xc6, 0x0c}
+	for _, tc := range []struct {
+		name   string
+		record []byte
+		check  func(l *LogItem) bool
+	}{
+		{"full record", protoTestCat(
+			protoTestFixed64Field(1, 1700000000123456789),
+			protoTestVarintField(2, 17),
+			protoTestStringField(3, "ERROR"),
+			protoTestBytesField(5, otlpTestString("boom")),
+			protoTestBytesField(6, otlpTestKeyValue("neg", protoTestVarintField(3, uint64(1<<64-5)))),
+			protoTestBytesField(6, otlpTestKeyValue("http.method", otlpTestString("GET"))),
+			protoTestBytesField(9, traceId),
+			protoTestBytesField(10, make([]byte, 8)),
+			protoTestStringField(12, "login"),
+			protoTestVarintField(108, 3),
+		), func(l *LogItem) bool {
+			return l.Hostname == "h1" && l.AppName == "svc" && l.Pid == 42 && l.Level == "err" && l.Message == "boom" &&
+				l.TraceId == "5b8efff798038103d269b633813fc60c" && l.SpanId == "" &&
+				l.Attributes["neg"] == "-5" && l.Attributes["http_method"] == "GET" && l.Attributes["k8s_pod"] == "p" &&
+				l.Attributes["otel_scope_name"] == "mylib" && l.Attributes["event_name"] == "login" &&
+				l.OriginatorTime.UnixNano() == 1700000000123456789
+		}},
+		{"observed time and severity text", protoTestCat(
+			protoTestFixed64Field(11, 1544712660300000000),
+			protoTestStringField(3, "WARN"),
+		), func(l *LogItem) bool {
+			return l.Level == "WARN" && l.OriginatorTime.UnixNano() == 1544712660300000000
+		}},
+		{"kvlist body", protoTestBytesField(5, protoTestBytesField(6, protoTestBytesField(1, otlpTestKeyValue("a", protoTestVarintField(3, 1))))),
+			func(l *LogItem) bool { return l.Message == `{"a":1}` }},
+		{"array body", protoTestBytesField(5, protoTestBytesField(5, protoTestCat(
+			protoTestBytesField(1, protoTestVarintField(2, 1)),
+			protoTestBytesField(1, protoTestFixed64Field(4, 0x3ff8000000000000)),
+		))), func(l *LogItem) bool { return l.Message == "[true,1.5]" }},
+		{"bytes body", protoTestBytesField(5, protoTestBytesField(7, []byte("hi"))),
+			func(l *LogItem) bool { return l.Message == "aGk=" }},
+		{"nested body at the limit", protoTestBytesField(5, otlpTestNested(otlpMaxDepth)),
+			func(l *LogItem) bool { return strings.Count(l.Message, "[") == otlpMaxDepth }},
+	} {
+		req, err := otlpDecodeLogsRequest(otlpTestRequest(tc.record))
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		items := req.logItems()
+		if len(items) != 1 || !tc.check(items[0]) {
+			t.Errorf("%s: got %+v", tc.name, items)
+		}
+	}
+}
+
+func TestOtlpDecodeLogsRequestMalformed(t *testing.T) {
+	valid := otlpTestRequest(protoTestBytesField(5, otlpTestString("boom")))
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		err  error
+	}{
+		{"truncated", valid[:20], errProtoTruncated},
+		{"truncated at end", valid[:len(valid)-1], errProtoTruncated},
+		{"resource logs as varint", protoTestVarintField(1, 3), errProtoWireType},
+		{"body as varint", otlpTestRequest(protoTestVarintField(5, 1)), errProtoWireType},
+		{"time as varint", otlpTestRequest(protoTestVarintField(1, 1)), errProtoWireType},
+		{"severity as string", otlpTestRequest(protoTestStringField(2, "x")), errProtoWireType},
+		{"nested too deep", otlpTestRequest(protoTestBytesField(5, otlpTestNested(otlpMaxDepth+1))), errOtlpTooDeep},
+		{"nested far too deep", otlpTestRequest(protoTestBytesField(5, otlpTestNested(2000))), errOtlpTooDeep},
+		{"kvlist nested too deep", otlpTestRequest(protoTestBytesField(6, otlpTestKeyValue("a", otlpTestNested(otlpMaxDepth+1)))), errOtlpTooDeep},
+	} {
+		if _, err := otlpDecodeLogsRequest(tc.in); err != tc.err {
+			t.Errorf("%s: error %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+func TestOtlpJSON(t *testing.T) {
+	initFieldProperties()
+	js := `{"resourceLogs":[{"resource":{"attributes":[
+		{"key":"service.name","value":{"stringValue":"s"}},
+		{"key":"process.pid","value":{"intValue":"7"}}]},
+	"scopeLogs":[{"scope":{"name":"x"},"logRecords":[
+		{"timeUnixNano":"1544712660300000000","severityNumber":10,"severityText":"Information",
+		 "traceId":"5b8efff798038103d269b633813fc60c","spanId":"eee19b7ec3c1b174","body":{"stringValue":"hi"},
+		 "attributes":[{"key":"b","value":{"boolValue":true}},{"key":"d","value":{"doubleValue":1.5}},{"key":"by","value":{"bytesValue":"aGk="}}]},
+		{"observedTimeUnixNano":1544712660300000000,"severityText":"WARN","body":{"arrayValue":{"values":[{"intValue":3}]}}}]}]}]}`
+	var req otlpLogsRequest
+	if err := json.Unmarshal([]byte(js), &req); err != nil {
+		t.Fatal(err)
+	}
+	items := req.logItems()
+	if len(items) != 2 {
+		t.Fatalf("got %d items", len(items))
+	}
+	l := items[0]
+	if l.AppName != "s" || l.Pid != 7 || l.Level != "info" || l.TraceId != "5b8efff798038103d269b633813fc60c" ||
+		l.SpanId != "eee19b7ec3c1b174" || l.Message != "hi" || l.Attributes["b"] != "true" ||
+		l.Attributes["d"] != "1.5" || l.Attributes["by"] != "aGk=" || l.OriginatorTime.UnixNano() != 1544712660300000000 {
+		t.Errorf("got %+v", l)
+	}
+	l = items[1]
+	if l.Level != "WARN" || l.Message != "[3]" || l.OriginatorTime.UnixNano() != 1544712660300000000 {
+		t.Errorf("got %+v", l)
+	}
+
+	for _, bad := range []string{
+		`{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"timeUnixNano":"x"}]}]}]}`,
+		`{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"traceId":"xyz"}]}]}]}`,
+		`{"resourceLogs":[{"scopeLogs":[{"logRecords":[{"body":{"intValue":"1.5"}}]}]}]}`,
+		`{"resourceLogs":[`,
+	} {
+		if err := json.Unmarshal([]byte(bad), &otlpLogsRequest{}); err == nil {
+			t.Errorf("%s: accepted", bad)
+		}
+	}
+}
+
+func TestOtlpLevel(t *testing.T) {
+	for _, tc := range []struct {
+		number int
+		text   string
+		want   string
+	}{
+		{1, "", "debug"}, {8, "", "debug"}, {9, "", "info"}, {13, "", "warn"},
+		{17, "", "err"}, {21, "", "crit"}, {24, "", "crit"},
+		{0, "Information", "Information"}, {25, "x", "x"}, {-1, "", ""},
+	} {
+		if got := otlpLevel(tc.number, tc.text); got != tc.want {
+			t.Errorf("otlpLevel(%d, %q) = %q, want %q", tc.number, tc.text, got, tc.want)
+		}
+	}
+}
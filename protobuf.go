@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+/*
+ * Just enough of the protocol buffers wire format to decode the messages
+ * of the OTLP and Loki push APIs without their generated code. A reader
+ * steps through the fields of one message:
+ *
+ *   for p.next() {
+ *           switch p.field {
+ *           case 1:
+ *                   name = p.string()
+ *           case 2:
+ *                   decodeThing(p.message())
+ *           default:
+ *                   p.skip()
+ *           }
+ *   }
+ *
+ * The first error is kept (shared with any embedded message's reader) and
+ * stops further decoding; check p.error() at the end.
+ */
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var (
+	errProtoTruncated = errors.New("protobuf message truncated")
+	errProtoWireType  = errors.New("protobuf field has unexpected wire type")
+)
+
+type protoReader struct {
+	b     []byte
+	field int
+	wire  int
+	err   *error
+}
+
+func newProtoReader(b []byte) *protoReader {
+	return &protoReader{b: b, err: new(error)}
+}
+
+func (p *protoReader) error() error {
+	return *p.err
+}
+
+func (p *protoReader) fail(err error) {
+	if *p.err == nil {
+		*p.err = err
+	}
+	p.b = nil
+}
+
+func (p *protoReader) readVarint() uint64 {
+	v, n := binary.Uvarint(p.b)
+	if n <= 0 {
+		p.fail(errProtoTruncated)
+		return 0
+	}
+	p.b = p.b[n:]
+	return v
+}
+
+func (p *protoReader) readFixed(n int) uint64 {
+	if len(p.b) < n {
+		p.fail(errProtoTruncated)
+		return 0
+	}
+	var v uint64
+	if n == 8 {
+		v = binary.LittleEndian.Uint64(p.b)
+	} else {
+		v = uint64(binary.LittleEndian.Uint32(p.b))
+	}
+	p.b = p.b[n:]
+	return v
+}
+
+// Move to the next field, returning false at the end of the message or
+// after an error
+func (p *protoReader) next() bool {
+	if *p.err != nil || len(p.b) == 0 {
+		return false
+	}
+	key := p.readVarint()
+	p.field = int(key >> 3)
+	p.wire = int(key & 7)
+	return *p.err == nil
+}
+
+func (p *protoReader) expect(wire int) bool {
+	if p.wire != wire {
+		p.fail(errProtoWireType)
+		return false
+	}
+	return *p.err == nil
+}
+
+func (p *protoReader) uint64() uint64 {
+	if !p.expect(protoVarint) {
+		return 0
+	}
+	return p.readVarint()
+}
+
+func (p *protoReader) int64() int64 {
+	return int64(p.uint64())
+}
+
+func (p *protoReader) bool() bool {
+	return p.uint64() != 0
+}
+
+func (p *protoReader) fixed64() uint64 {
+	if !p.expect(protoFixed64) {
+		return 0
+	}
+	return p.readFixed(8)
+}
+
+func (p *protoReader) double() float64 {
+	return math.Float64frombits(p.fixed64())
+}
+
+func (p *protoReader) bytes() []byte {
+	if !p.expect(protoBytes) {
+		return nil
+	}
+	n := p.readVarint()
+	if *p.err != nil {
+		return nil
+	}
+	if n > uint64(len(p.b)) {
+		p.fail(errProtoTruncated)
+		return nil
+	}
+	b := p.b[:n]
+	p.b = p.b[n:]
+	return b
+}
+
+func (p *protoReader) string() string {
+	return string(p.bytes())
+}
+
+// A reader for an embedded message
+func (p *protoReader) message() *protoReader {
+	return &protoReader{b: p.bytes(), err: p.err}
+}
+
+func (p *protoReader) skip() {
+	switch p.wire {
+	case protoVarint:
+		p.readVarint()
+	case protoFixed64:
+		p.readFixed(8)
+	case protoBytes:
+		p.bytes()
+	case protoFixed32:
+		p.readFixed(4)
+	default:
+		p.fail(errProtoWireType)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func protoTestVarint(v uint64) []byte {
+	b := make([]byte, binary.MaxVarintLen64)
+	return b[:binary.PutUvarint(b, v)]
+}
+
+func protoTestKey(field int, wire int) []byte {
+	return protoTestVarint(uint64(field<<3 | wire))
+}
+
+func protoTestCat(parts ...[]byte) []byte {
+	return bytes.Join(parts, nil)
+}
+
+func protoTestVarintField(field int, v uint64) []byte {
+	return protoTestCat(protoTestKey(field, protoVarint), protoTestVarint(v))
+}
+
+func protoTestFixed64Field(field int, v uint64) []byte {
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, v)
+	return protoTestCat(protoTestKey(field, protoFixed64), b)
+}
+
+func protoTestBytesField(field int, b []byte) []byte {
+	return protoTestCat(protoTestKey(field, protoBytes), protoTestVarint(uint64(len(b))), b)
+}
+
+func protoTestStringField(field int, s string) []byte {
+	return protoTestBytesField(field, []byte(s))
+}
+
+func TestProtoReader(t *testing.T) {
+	msg := protoTestCat(
+		protoTestVarintField(1, 150),
+		protoTestVarintField(2, math.MaxUint64),
+		protoTestVarintField(3, 1),
+		protoTestFixed64Field(4, math.Float64bits(1.5)),
+		protoTestStringField(5, "hello"),
+		protoTestBytesField(6, protoTestVarintField(1, 7)),
+		protoTestCat(protoTestKey(7, protoFixed32), []byte{1, 2, 3, 4}),
+		protoTestStringField(5000, "unknown"),
+	)
+	p := newProtoReader(msg)
+	var fields []int
+	for p.next() {
+		fields = append(fields, p.field)
+		switch p.field {
+		case 1:
+			if v := p.uint64(); v != 150 {
+				t.Errorf("uint64 = %d", v)
+			}
+		case 2:
+			if v := p.int64(); v != -1 {
+				t.Errorf("int64 = %d", v)
+			}
+		case 3:
+			if !p.bool() {
+				t.Error("bool is false")
+			}
+		case 4:
+			if v := p.double(); v != 1.5 {
+				t.Errorf("double = %v", v)
+			}
+		case 5:
+			if v := p.string(); v != "hello" {
+				t.Errorf("string = %q", v)
+			}
+		case 6:
+			q := p.message()
+			if !q.next() || q.field != 1 || q.uint64() != 7 || q.next() {
+				t.Error("bad embedded message")
+			}
+		default:
+			p.skip()
+		}
+	}
+	if err := p.error(); err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != 8 || fields[7] != 5000 {
+		t.Errorf("fields = %v", fields)
+	}
+}
+
+func TestProtoReaderMalformed(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		err  error
+	}{
+		{"truncated key", []byte{0x80}, errProtoTruncated},
+		{"truncated varint", []byte{0x08, 0x96}, errProtoTruncated},
+		{"overlong varint", protoTestCat([]byte{0x08}, bytes.Repeat([]byte{0xff}, 11), []byte{0x01}), errProtoTruncated},
+		{"truncated fixed64", protoTestCat(protoTestKey(4, protoFixed64), []byte{1, 2, 3}), errProtoTruncated},
+		{"truncated fixed32", protoTestCat(protoTestKey(9, protoFixed32), []byte{1, 2, 3}), errProtoTruncated},
+		{"truncated length", []byte{0x2a}, errProtoTruncated},
+		{"length beyond message", []byte{0x2a, 0x05, 'a', 'b'}, errProtoTruncated},
+		{"huge length", protoTestCat([]byte{0x2a}, protoTestVarint(math.MaxUint64), []byte{'a'}), errProtoTruncated},
+		{"string as varint", protoTestVarintField(5, 1), errProtoWireType},
+		{"varint as bytes", protoTestStringField(1, "x"), errProtoWireType},
+		{"double as varint", protoTestVarintField(4, 1), errProtoWireType},
+		{"message as varint", protoTestVarintField(6, 1), errProtoWireType},
+		{"start group", protoTestKey(9, 3), errProtoWireType},
+		{"unknown wire type", protoTestKey(9, 7), errProtoWireType},
+		{"truncated embedded message", protoTestBytesField(6, []byte{0x08}), errProtoTruncated},
+	} {
+		p := newProtoReader(tc.in)
+		for p.next() {
+			switch p.field {
+			case 1:
+				p.uint64()
+			case 4:
+				p.double()
+			case 5:
+				p.string()
+			case 6:
+				for q := p.message(); q.next(); {
+					q.uint64()
+				}
+			default:
+				p.skip()
+			}
+		}
+		if err := p.error(); err != tc.err {
+			t.Errorf("%s: error %v, want %v", tc.name, err, tc.err)
+		}
+	}
+}
+
+// The first error sticks, and stops the reader and any embedded ones
+func TestProtoReaderStickyError(t *testing.T) {
+	p := newProtoReader(protoTestCat(protoTestStringField(1, "x"), protoTestVarintField(2, 1)))
+	if !p.next() || p.uint64() != 0 || p.error() != errProtoWireType {
+		t.Fatal("no wire type error")
+	}
+	if p.next() {
+		t.Error("read on past an error")
+	}
+	if q := p.message(); q.next() || q.error() != errProtoWireType {
+		t.Error("embedded reader does not share the error")
+	}
+}
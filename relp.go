@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/jeromer/syslogparser"
+	"github.com/jeromer/syslogparser/rfc3164"
+	"github.com/jeromer/syslogparser/rfc5424"
+	"io"
+	"log"
+	"net"
+	"strconv"
+)
+
+/*
+ * RELP, the Reliable Event Logging Protocol, as spoken by rsyslog's omrelp.
+ * Each frame is
+ *
+ *   TXNR SP COMMAND SP DATALEN [SP DATA] LF
+ *
+ * and every command is answered with a 'rsp' frame carrying the same TXNR.
+ * We acknowledge a syslog message only once it has been committed to the
+ * chain (by whichever instance holds its shard group's lease), so a sender
+ * which has had its acknowledgement knows the message is safe. Senders may have
+ * several messages outstanding; those already received are committed as one
+ * batch.
+ */
+
+const (
+	relpMaxDataLen = 1 * 1024 * 1024
+	relpOffers     = "relp_version=0\nrelp_software=slogger\ncommands=syslog"
+)
+
+type relpFrame struct {
+	txnr    int64
+	command string
+	data    []byte
+}
+
+// Read a space or newline terminated token of at most max bytes
+func relpToken(r *bufio.Reader, max int) (string, byte, error) {
+	var token []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", 0, err
+		}
+		if c == ' ' || c == '\n' {
+			return string(token), c, nil
+		}
+		if len(token) >= max {
+			return "", 0, errors.New("RELP header field too long")
+		}
+		token = append(token, c)
+	}
+}
+
+func readRelpFrame(r *bufio.Reader) (*relpFrame, error) {
+	f := &relpFrame{}
+	txnr, sep, err := relpToken(r, 9)
+	if err != nil {
+		return nil, err
+	}
+	// Transaction numbers start at 1
+	if f.txnr, err = strconv.ParseInt(txnr, 10, 64); err != nil || f.txnr < 1 || sep != ' ' {
+		return nil, errors.New("bad RELP TXNR")
+	}
+	if f.command, sep, err = relpToken(r, 32); err != nil {
+		return nil, err
+	}
+	if sep != ' ' {
+		return nil, errors.New("bad RELP command")
+	}
+	datalen, sep, err := relpToken(r, 9)
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(datalen)
+	if err != nil || n < 0 || n > relpMaxDataLen || (n == 0) != (sep == '\n') {
+		return nil, errors.New("bad RELP DATALEN")
+	}
+	if n > 0 {
+		f.data = make([]byte, n)
+		if _, err := io.ReadFull(r, f.data); err != nil {
+			return nil, err
+		}
+		if c, err := r.ReadByte(); err != nil || c != '\n' {
+			return nil, errors.New("bad RELP trailer")
+		}
+	}
+	return f, nil
+}
+
+func writeRelpResponse(w *bufio.Writer, txnr int64, data string) {
+	if data == "" {
+		fmt.Fprintf(w, "%d rsp 0\n", txnr)
+	} else {
+		fmt.Fprintf(w, "%d rsp %d %s\n", txnr, len(data), data)
+	}
+}
+
+// Parse a syslog message as RFC 5424 if it has a version after the PRI,
+// or RFC 3164 otherwise. A message which cannot be parsed is kept whole.
+func parseSyslogMessage(msg []byte, client string) syslogparser.LogParts {
+	var parts syslogparser.LogParts
+	rfc5424Message := false
+	for i := 0; i < len(msg)-2 && i < 5; i++ {
+		if msg[i] == '>' {
+			rfc5424Message = msg[i+1] >= '1' && msg[i+1] <= '9' && msg[i+2] == ' '
+			break
+		}
+	}
+	if rfc5424Message {
+		p := rfc5424.NewParser(msg)
+		if err := p.Parse(); err == nil {
+			parts = p.Dump()
+		}
+	} else {
+		p := rfc3164.NewParser(msg)
+		if err := p.Parse(); err == nil {
+			parts = p.Dump()
+		}
+	}
+	if parts == nil {
+		parts = syslogparser.LogParts{"content": string(msg)}
+	}
+	parts["client"] = client
+	return parts
+}
+
+func relpServe(db *Database, conn net.Conn, listener string) {
+	defer conn.Close()
+	client := conn.RemoteAddr().String()
+	peer := ""
+	if t, ok := conn.(*tls.Conn); ok {
+		if err := t.Handshake(); err != nil {
+			log.Printf("RELP TLS handshake with %s failed: %v\n", client, err)
+			return
+		}
+		if certs := t.ConnectionState().PeerCertificates; len(certs) > 0 {
+			peer = certs[0].Subject.CommonName
+		}
+	}
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	open := false
+	var pending *relpFrame
+	for {
+		f := pending
+		pending = nil
+		if f == nil {
+			var err error
+			if f, err = readRelpFrame(r); err != nil {
+				if err != io.EOF {
+					log.Printf("RELP session with %s failed: %v\n", client, err)
+				}
+				return
+			}
+		}
+
+		switch {
+		case f.command == "open":
+			open = true
+			writeRelpResponse(w, f.txnr, "200 OK\n"+relpOffers)
+		case f.command == "close":
+			writeRelpResponse(w, f.txnr, "")
+			w.Flush()
+			return
+		case f.command == "syslog" && open:
+			// Commit whatever further messages have already arrived with
+			// this one, then acknowledge them all
+			frames := []*relpFrame{f}
+			for r.Buffered() > 0 && len(frames) < ingestBatchSize {
+				next, err := readRelpFrame(r)
+				if err != nil {
+					log.Printf("RELP session with %s failed: %v\n", client, err)
+					return
+				}
+				if next.command != "syslog" {
+					pending = next
+					break
+				}
+				frames = append(frames, next)
+			}
+			batch := make([]syslogparser.LogParts, len(frames))
+			for i, frame := range frames {
+				batch[i] = parseSyslogMessage(frame.data, client)
+				if peer != "" {
+					batch[i]["tls_peer"] = peer
+				}
+			}
+			status := "200 OK"
+			if err := processLogParts(db, batch, listener); err != nil {
+				status = "500 Cannot commit message"
+			}
+			for _, frame := range frames {
+				writeRelpResponse(w, frame.txnr, status)
+			}
+		default:
+			writeRelpResponse(w, f.txnr, "500 Unexpected command "+f.command)
+		}
+		if err := w.Flush(); err != nil {
+			log.Printf("RELP session with %s failed: %v\n", client, err)
+			return
+		}
+	}
+}
+
+func relpServerStart(db *Database, listen string, tlsConfig *tls.Config) {
+	var ln net.Listener
+	var err error
+	if tlsConfig != nil {
+		ln, err = tls.Listen("tcp", listen, tlsConfig)
+	} else {
+		ln, err = net.Listen("tcp", listen)
+	}
+	if err != nil {
+		log.Fatalf("Cannot listen for RELP on %s: %v", listen, err)
+	}
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Printf("Cannot accept RELP connection on %s: %v\n", listen, err)
+			continue
+		}
+		go relpServe(db, conn, listen)
+	}
+}
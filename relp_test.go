@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadRelpFrame(t *testing.T) {
+	for _, tc := range []struct {
+		in      string
+		txnr    int64
+		command string
+		data    string
+	}{
+		{"1 open 85 relp_version=0\nrelp_software=librelp,1.2.5,http://librelp.adiscon.com\ncommands=syslog\n",
+			1, "open", "relp_version=0\nrelp_software=librelp,1.2.5,http://librelp.adiscon.com\ncommands=syslog"},
+		{"2 syslog 5 hello\n", 2, "syslog", "hello"},
+		{"3 close 0\n", 3, "close", ""},
+		{"999999999 syslog 3 a\nb\n", 999999999, "syslog", "a\nb"},
+		{"4 syslog 3 a b\n", 4, "syslog", "a b"},
+	} {
+		f, err := readRelpFrame(bufio.NewReader(strings.NewReader(tc.in)))
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if f.txnr != tc.txnr || f.command != tc.command || string(f.data) != tc.data {
+			t.Errorf("%q: got %d %s %q, want %d %s %q", tc.in, f.txnr, f.command, f.data, tc.txnr, tc.command, tc.data)
+		}
+	}
+}
+
+func TestReadRelpFrameMalformed(t *testing.T) {
+	for _, in := range []string{
+		"",
+		"1",
+		"1 ",
+		"1 syslog",
+		"1 syslog ",
+		"1 syslog 5 hel",
+		"1 syslog 5 hello",
+		"x open 0\n",
+		"-1 open 0\n",
+		"0 open 0\n",
+		"1234567890 open 0\n",
+		"1\nopen 0\n",
+		"1 open\n0\n",
+		"1 " + strings.Repeat("c", 33) + " 0\n",
+		"1 syslog 0 \n",
+		"1 syslog 3\nabc\n",
+		"1 syslog -1 \n",
+		"1 syslog x \n",
+		"1 syslog 1234567890 x\n",
+		"1 syslog 1048577 x\n",
+		"1 syslog 5 hello!\n",
+		"1 syslog 3 abc",
+	} {
+		if f, err := readRelpFrame(bufio.NewReader(strings.NewReader(in))); err == nil {
+			t.Errorf("%q: accepted as %+v", in, f)
+		}
+	}
+}
+
+// Frames follow one another on a connection
+func TestReadRelpFrameSequence(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("1 open 0\n2 syslog 5 hello\n3 close 0\n"))
+	for _, want := range []string{"open", "syslog", "close"} {
+		f, err := readRelpFrame(r)
+		if err != nil || f.command != want {
+			t.Fatalf("got %+v, %v, want %s", f, err, want)
+		}
+	}
+	if _, err := readRelpFrame(r); err == nil {
+		t.Error("read a frame past the end")
+	}
+}
+
+func TestWriteRelpResponse(t *testing.T) {
+	for _, tc := range []struct {
+		txnr int64
+		data string
+		want string
+	}{
+		{2, "200 OK", "2 rsp 6 200 OK\n"},
+		{3, "", "3 rsp 0\n"},
+		{4, "500 ü", "4 rsp 6 500 ü\n"},
+	} {
+		var b bytes.Buffer
+		w := bufio.NewWriter(&b)
+		writeRelpResponse(w, tc.txnr, tc.data)
+		w.Flush()
+		if b.String() != tc.want {
+			t.Errorf("got %q, want %q", b.String(), tc.want)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"net/http"
+	"time"
+)
+
+/*
+ * The integrity scanner repeatedly walks the chain of every shard group,
+ * re-verifying each item's hash and its link to its predecessor. Its
+ * position is persisted so that it resumes where it left off after a
+ * restart, and it is rate limited so as not to swamp Mongo.
+ *
+ * Any problem found raises a tamper alert: a log line, a metric, an
+ * optional webhook and a tamper event written into the chain itself. Each
+ * problem is alerted once, not once per pass: the problems alerted are kept
+ * with the scan state, and those not found again in a pass are dropped so
+ * they will be alerted afresh should they recur.
+ *
+ * Each shard group is scanned by the instance holding its lease.
+ */
+
+var (
+	scanInterval      = 0    // Seconds between passes; 0 disables the scanner
+	scanRate          = 1000 // Maximum items verified per second
+	scanBatchSize     = 1000
+	scanWebhook       string
+	scanStateCollName = "scanstate"
+)
+
+var (
+	scannedItems  = expvar.NewInt("scanner_items_verified")
+	scannedPasses = expvar.NewInt("scanner_passes")
+	tamperAlerts  = expvar.NewInt("tamper_alerts")
+)
+
+// The metrics served at /debug/vars
+var scannerMetrics = map[string]*expvar.Int{
+	"scanner_items_verified": scannedItems,
+	"scanner_passes":         scannedPasses,
+	"tamper_alerts":          tamperAlerts,
+}
+
+type scanState struct {
+	ShardGroup int   `bson:"_id"`
+	SequenceId int64 // The next sequence id to verify
+	Hash       string
+	Pass       int
+	Time       time.Time
+	Alerted    []string // Problems alerted in earlier passes
+	Found      []string // Problems found so far this pass
+}
+
+type tamperAlert struct {
+	ShardGroup int       `json:"shard_group"`
+	Kind       string    `json:"kind"`
+	From       int64     `json:"from"`
+	To         int64     `json:"to"`
+	Time       time.Time `json:"time"`
+	Message    string    `json:"message"`
+}
+
+func (db *Database) getScanStateCollection(s *mgo.Session) *mgo.Collection {
+	return s.DB(databaseName).C(scanStateCollName)
+}
+
+func stringInList(s string, list []string) bool {
+	for _, t := range list {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+func raiseTamperAlert(db *Database, state *scanState, a *tamperAlert) {
+	key := fmt.Sprintf("%s/%d/%d", a.Kind, a.From, a.To)
+	if stringInList(key, state.Found) {
+		return
+	}
+	state.Found = append(state.Found, key)
+	if stringInList(key, state.Alerted) {
+		return
+	}
+
+	log.Printf("TAMPER: %s\n", a.Message)
+	tamperAlerts.Add(1)
+
+	if scanWebhook != "" {
+		go func() {
+			b, err := json.Marshal(a)
+			if err != nil {
+				log.Printf("Cannot marshal tamper alert: %v\n", err)
+				return
+			}
+			client := &http.Client{Timeout: 30 * time.Second}
+			resp, err := client.Post(scanWebhook, "application/json", bytes.NewReader(b))
+			if err != nil {
+				log.Printf("Cannot post tamper alert to webhook: %v\n", err)
+				return
+			}
+			resp.Body.Close()
+		}()
+	}
+
+	event := LogItem{
+		Message:  a.Message,
+		Facility: "slogger",
+		Level:    "alert",
+	}
+	event.normalise()
+	event.ShardGroup = a.ShardGroup
+	event.makeHashAndInsert(db)
+}
+
+func alertReport(db *Database, state *scanState, r *chainReport) {
+	alert := func(kind string, from int64, to int64, what string) {
+		raiseTamperAlert(db, state, &tamperAlert{
+			ShardGroup: r.ShardGroup,
+			Kind:       kind,
+			From:       from,
+			To:         to,
+			Time:       time.Now(),
+			Message:    fmt.Sprintf("Tamper detected in shard group %d: %s", r.ShardGroup, what),
+		})
+	}
+	for _, g := range r.Gaps {
+		alert("gap", g.From, g.To, fmt.Sprintf("sequence ids %d to %d are missing", g.From, g.To))
+	}
+	for _, s := range r.Duplicates {
+		alert("duplicate", s, s, fmt.Sprintf("sequence id %d is duplicated", s))
+	}
+	for _, s := range r.BrokenLinks {
+		alert("broken_link", s, s, fmt.Sprintf("sequence id %d does not link to its predecessor", s))
+	}
+	for _, s := range r.BadHashes {
+		alert("bad_hash", s, s, fmt.Sprintf("sequence id %d does not match its hash", s))
+	}
+	for _, s := range r.UnknownKeys {
+		alert("unknown_key", s, s, fmt.Sprintf("sequence id %d has a hash key id not in the keyring", s))
+	}
+}
+
+// Verify the next batch of a shard group's chain, returning false once the
+// end of the chain has been reached
+func scanBatch(db *Database, s *mgo.Session, state *scanState) bool {
+	c := db.getLogItemCollection(s)
+	v := newChainVerifier(state.ShardGroup, state.SequenceId, -1)
+	if state.SequenceId > 0 {
+		v.seed(&LogItem{SequenceId: state.SequenceId - 1, Hash: state.Hash})
+	}
+
+	iter := c.Find(bson.M{"shardgroup": state.ShardGroup, "sequenceid": bson.M{"$gte": state.SequenceId}}).Sort("sequenceid", "_id").Limit(scanBatchSize).Iter()
+	var item LogItem
+	for iter.Next(&item) {
+		v.add(&item)
+		state.SequenceId = item.SequenceId + 1
+		state.Hash = item.Hash
+	}
+	if err := iter.Close(); err != nil {
+		log.Panicf("Error while iterating: %v\n", err)
+	}
+
+	r := v.finish()
+	scannedItems.Add(int64(r.Count))
+	if !r.Intact {
+		alertReport(db, state, r)
+	}
+	return r.Count >= scanBatchSize
+}
+
+func scanShardGroup(db *Database, s *mgo.Session, shardGroup int) {
+	states := db.getScanStateCollection(s)
+	state := scanState{ShardGroup: shardGroup}
+	if err := states.FindId(shardGroup).One(&state); err != nil && err != mgo.ErrNotFound {
+		log.Panicf("Query returned error %v\n", err)
+	}
+
+	for {
+		start := time.Now()
+		more := scanBatch(db, s, &state)
+		if !more {
+			// Start again from the beginning next pass, forgetting problems
+			// which are no longer there
+			state.SequenceId = 0
+			state.Hash = ""
+			state.Pass++
+			state.Alerted = state.Found
+			state.Found = nil
+		}
+		state.Time = time.Now()
+		if _, err := states.UpsertId(shardGroup, &state); err != nil {
+			log.Panicf("Cannot save scanner state %v\n", err)
+		}
+		if !more || !holdsLease(db, s, shardGroup) {
+			return
+		}
+		// Rate limit by sleeping for whatever remains of the time the batch
+		// should have taken
+		if scanRate > 0 {
+			time.Sleep(time.Duration(scanBatchSize)*time.Second/time.Duration(scanRate) - time.Since(start))
+		}
+	}
+}
+
+func scannerRun(db *Database) {
+	for {
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("panic caught in scanner: %+v", err)
+				}
+			}()
+			sessionCopy := db.mongoSession.Copy()
+			defer sessionCopy.Close()
+			for _, sg := range db.shardGroups(sessionCopy) {
+				if holdsLease(db, sessionCopy, sg) {
+					scanShardGroup(db, sessionCopy, sg)
+				}
+			}
+			scannedPasses.Add(1)
+		}()
+		time.Sleep(time.Duration(scanInterval) * time.Second)
+	}
+}
+
+func startScanner(db *Database) {
+	if scanInterval <= 0 {
+		return
+	}
+	log.Printf("Starting integrity scanner every %d seconds\n", scanInterval)
+	go scannerRun(db)
+}
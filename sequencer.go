@@ -0,0 +1,306 @@
+package main
+
+import (
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+/*
+ * Each shard group has a single sequencer goroutine which chains its items
+ * in order. The sequencer keeps the head of the chain in memory, so it need
+ * only read it from Mongo at startup, or if an insert conflicts because
+ * something outside this process has extended the chain. Writers within the
+ * process therefore never race each other for a sequence id.
+ *
+ * The sequencer group commits: it gathers requests for up to ingestlatency
+ * milliseconds or ingestbatchsize items, chains them all in memory and
+ * writes them with a single insert (or one per ingestbatchsize items, should
+ * a request be larger than that), and only then replies to the writers.
+ * Even with no latency configured, requests arriving while a write is in
+ * progress are gathered into the next batch.
+ *
+ * If another instance holds the shard group's lease, the sequencer queues
+ * its items for that instance instead, and the writers wait for that
+ * instance to chain them (see lease.go).
+ */
+
+var (
+	ingestLatency   = 0    // Milliseconds to wait for a batch to fill
+	ingestBatchSize = 1000 // Maximum items per batch
+)
+
+type sequenceRequest struct {
+	items   []*LogItem
+	drained bool             // Drained from the pending collection, so must not be queued again
+	pending []bson.ObjectId  // Set if queued for another instance to chain
+	done    chan interface{} // nil, or the value of a panic while chaining
+}
+
+type sequencer struct {
+	shardGroup int
+	requests   chan *sequenceRequest
+	haveHead   bool
+	head       LogItem // Only the chain fields are kept
+}
+
+var (
+	sequencersMutex sync.Mutex
+	sequencers      = make(map[int]*sequencer)
+)
+
+// The sequencer for a shard group, started on first use
+func getSequencer(db *Database, shardGroup int) *sequencer {
+	sequencersMutex.Lock()
+	defer sequencersMutex.Unlock()
+	sq, ok := sequencers[shardGroup]
+	if !ok {
+		sq = &sequencer{
+			shardGroup: shardGroup,
+			requests:   make(chan *sequenceRequest, 1000),
+		}
+		sequencers[shardGroup] = sq
+		go sq.run(db)
+	}
+	return sq
+}
+
+// Chain items onto the end of their shard groups' chains, in order within
+// each shard group, or have the instances holding their leases do so. Panics
+// if any cannot be inserted.
+func sequenceLogItems(db *Database, items []*LogItem, drained bool) {
+	byShardGroup := make(map[int][]*LogItem)
+	var shardGroups []int
+	for _, l := range items {
+		if _, ok := byShardGroup[l.ShardGroup]; !ok {
+			shardGroups = append(shardGroups, l.ShardGroup)
+		}
+		byShardGroup[l.ShardGroup] = append(byShardGroup[l.ShardGroup], l)
+	}
+
+	requests := make([]*sequenceRequest, len(shardGroups))
+	for i, sg := range shardGroups {
+		requests[i] = &sequenceRequest{items: byShardGroup[sg], drained: drained, done: make(chan interface{}, 1)}
+		getSequencer(db, sg).requests <- requests[i]
+	}
+	var failure interface{}
+	for _, req := range requests {
+		if err := <-req.done; err != nil {
+			failure = err
+		}
+	}
+	for _, req := range requests {
+		if req.pending != nil && failure == nil {
+			func() {
+				defer func() {
+					failure = recover()
+				}()
+				waitPending(db, req.items, req.pending)
+			}()
+		}
+	}
+	if failure != nil {
+		panic(failure)
+	}
+}
+
+func (sq *sequencer) run(db *Database) {
+	sessionCopy := db.mongoSession.Copy()
+	defer sessionCopy.Close()
+	for req := range sq.requests {
+		batch := sq.gather(req)
+		failure := sq.process(db, sessionCopy, batch)
+		for _, r := range batch {
+			r.done <- failure
+		}
+	}
+}
+
+// Gather further requests to go in a batch with the first
+func (sq *sequencer) gather(first *sequenceRequest) []*sequenceRequest {
+	batch := []*sequenceRequest{first}
+	size := len(first.items)
+	timeout := time.After(time.Duration(ingestLatency) * time.Millisecond)
+	for size < ingestBatchSize {
+		select {
+		case req := <-sq.requests:
+			batch = append(batch, req)
+			size += len(req.items)
+			continue
+		default:
+		}
+		if ingestLatency <= 0 {
+			break
+		}
+		select {
+		case req := <-sq.requests:
+			batch = append(batch, req)
+			size += len(req.items)
+		case <-timeout:
+			return batch
+		}
+	}
+	return batch
+}
+
+func (sq *sequencer) process(db *Database, s *mgo.Session, batch []*sequenceRequest) (failure interface{}) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("panic caught in sequencer for shard group %d: %+v", sq.shardGroup, err)
+			// Re-read the head and start with a fresh connection next time
+			sq.haveHead = false
+			s.Refresh()
+			failure = err
+		}
+	}()
+	if !holdsLease(db, s, sq.shardGroup) {
+		// The owner may move the chain on, so forget our head
+		sq.haveHead = false
+		for _, req := range batch {
+			if req.drained {
+				log.Panicf("Lost lease on shard group %d while draining\n", sq.shardGroup)
+			}
+		}
+		for _, req := range batch {
+			req.pending = queuePending(db, s, req.items)
+		}
+		return nil
+	}
+	var items []*LogItem
+	for _, req := range batch {
+		items = append(items, req.items...)
+	}
+	// A single request may be larger than a batch, so write at most
+	// ingestbatchsize items at a time
+	c := db.getLogItemCollection(s)
+	for len(items) > ingestBatchSize {
+		sq.insert(db, s, c, items[:ingestBatchSize])
+		items = items[ingestBatchSize:]
+	}
+	sq.insert(db, s, c, items)
+	return nil
+}
+
+func (sq *sequencer) readHead(c *mgo.Collection) {
+	sq.head = LogItem{SequenceId: -1}
+	if err := c.Find(bson.M{"shardgroup": sq.shardGroup}).Select(bson.M{"sequenceid": 1, "hash": 1, "keyid": 1}).Sort("-sequenceid").Limit(1).One(&sq.head); err != nil {
+		if err != mgo.ErrNotFound {
+			log.Panicf("Query returned error %v\n", err)
+		}
+		sq.head = LogItem{SequenceId: -1}
+	}
+	sq.haveHead = true
+}
+
+func (sq *sequencer) setHead(l *LogItem) {
+	sq.head = LogItem{SequenceId: l.SequenceId, Hash: l.Hash, KeyId: l.KeyId}
+}
+
+// Chain items in memory onto the head, preceded by a key rotation marker if
+// the key has changed
+func (sq *sequencer) chain(items []*LogItem, key *hashKey) []*LogItem {
+	var chained []*LogItem
+	if sq.head.SequenceId >= 0 && sq.head.KeyId != key.id {
+		marker := newKeyRotationItem(sq.head.KeyId, key.id)
+		marker.ShardGroup = sq.shardGroup
+		chained = append(chained, marker)
+	}
+	chained = append(chained, items...)
+
+	previous := sq.head
+	for _, l := range chained {
+		l.setHashKey(key)
+		l.PreviousHash = previous.Hash
+		l.SequenceId = previous.SequenceId + 1
+		if err := l.makeHash(); err != nil {
+			log.Panicf("Cannot hash item with key '%s': %v\n", l.KeyId, err)
+		}
+		previous = *l
+	}
+	return chained
+}
+
+// The number of chained items at the start of a list which are in the
+// database, after an insert failed part way through
+func (sq *sequencer) insertedPrefix(c *mgo.Collection, chained []*LogItem) int {
+	for i, l := range chained {
+		var item LogItem
+		if err := c.Find(bson.M{"shardgroup": l.ShardGroup, "sequenceid": l.SequenceId}).Select(bson.M{"hash": 1}).One(&item); err != nil {
+			if err != mgo.ErrNotFound {
+				log.Panicf("Query returned error %v\n", err)
+			}
+			return i
+		}
+		if item.Hash != l.Hash {
+			return i
+		}
+	}
+	return len(chained)
+}
+
+func (sq *sequencer) insert(db *Database, s *mgo.Session, c *mgo.Collection, items []*LogItem) {
+	backoff := initialBackoff
+
+	for iteration := 0; len(items) > 0; iteration++ {
+		key, ok := activeHashKey(time.Now())
+		if !ok {
+			log.Panic("No hash key is active")
+		}
+
+		if !sq.haveHead {
+			sq.readHead(c)
+		}
+		if !checkChainHead(c, sq.shardGroup, sq.head.SequenceId+1) {
+			sq.haveHead = false
+			continue
+		}
+
+		chained := sq.chain(items, key)
+		docs := make([]interface{}, len(chained))
+		for i, l := range chained {
+			docs[i] = l
+		}
+		err := c.Insert(docs...)
+		inserted := len(chained)
+		if err != nil {
+			if !mgo.IsDup(err) {
+				log.Panicf("Could not insert record %v\n", err)
+			}
+			// Something else has extended the chain. The insert stops at
+			// the first failure, so some of the batch may be in.
+			inserted = sq.insertedPrefix(c, chained)
+		}
+
+		if inserted > 0 {
+			last := chained[inserted-1]
+			sq.setHead(last)
+			recordChainHead(db, s, last)
+			if chained[0] != items[0] {
+				log.Printf("Recorded hash key rotation to '%s' in shard group %d\n", key.id, sq.shardGroup)
+				inserted--
+			}
+			for _, l := range items[:inserted] {
+				l.Verified = true
+			}
+			items = items[inserted:]
+		}
+		if err == nil {
+			if backoff >= maximumBackoff {
+				log.Printf("Succeeded only after %d iterations\n", iteration)
+			}
+			return
+		}
+
+		sq.haveHead = false
+		if iteration >= iterationsBeforeBackoff {
+			time.Sleep(time.Duration(1+rand.Int()%backoff) * time.Microsecond)
+			backoff *= 2
+			if backoff > maximumBackoff {
+				backoff = maximumBackoff
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"path"
+)
+
+/*
+ * Each shard group has its own chain. Incoming items are mapped to a shard
+ * group by the first rule in the configuration which matches them, or to
+ * the default shard group if none does. A rule matches if every criterion
+ * it gives matches; criteria are shell patterns (as per path.Match) against
+ * the item's account group id, client name (from its TLS certificate) or
+ * hostname, or the listen address of the service which received it.
+ */
+
+type shardRule struct {
+	shardGroup     int
+	accountGroupId string
+	clientName     string
+	listener       string
+	hostname       string
+}
+
+var (
+	shardRules        []shardRule
+	defaultShardGroup = 1234
+)
+
+func patternMatches(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, err := path.Match(pattern, value)
+	return err == nil && matched
+}
+
+func (r *shardRule) matches(l *LogItem, listener string) bool {
+	return patternMatches(r.accountGroupId, l.AccountGroupId) &&
+		patternMatches(r.clientName, l.ClientName) &&
+		patternMatches(r.listener, listener) &&
+		patternMatches(r.hostname, l.Hostname)
+}
+
+// Set the shard group of an item received on a given listener
+func (l *LogItem) assignShardGroup(listener string) {
+	for i := range shardRules {
+		if shardRules[i].matches(l, listener) {
+			l.ShardGroup = shardRules[i].shardGroup
+			return
+		}
+	}
+	l.ShardGroup = defaultShardGroup
+}
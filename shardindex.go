@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"sort"
+	"time"
+)
+
+/*
+ * The shard index gives a global order across shard groups. At the end of
+ * every window of shardindexinterval seconds in which anything has been
+ * chained, an index entry is written recording the head of every shard
+ * group and how many items each gained in the window. Entries are hash
+ * chained in the same way as log items, so the index as a whole forms a
+ * combined cross-shard chain.
+ *
+ * An item belongs to the window in which it was chained, so windows are
+ * exact ranges of sequence ids, but an item's timestamp may fall slightly
+ * before the start of its window.
+ *
+ * An entry's hash is the hex SHA-256 of the following, with integers big
+ * endian and strings as a 32 bit length then the bytes:
+ *
+ *   "slogger-shardindex\x00"
+ *   window (i64), start and end (i64 nanoseconds since the epoch)
+ *   previous_hash (string), number of shards (u32)
+ *   per shard: shard_group (i64), sequence_id (i64), hash (string), count (i64)
+ */
+
+var (
+	shardIndexInterval = 60 // Seconds per window; 0 disables the index
+	shardIndexCollName = "shardindex"
+)
+
+const shardIndexMagic = "slogger-shardindex\x00"
+
+type ShardHead struct {
+	ShardGroup int    `json:"shard_group"`
+	SequenceId int64  `json:"sequence_id"` // -1 if the shard group is empty
+	Hash       string `json:"hash"`
+	Count      int64  `json:"count"` // Items chained during the window
+}
+
+type ShardIndexEntry struct {
+	Window       int64       `json:"window"`
+	Start        time.Time   `json:"start"`
+	End          time.Time   `json:"end"`
+	Shards       []ShardHead `json:"shards"`
+	PreviousHash string      `json:"previous_hash"`
+	Hash         string      `json:"hash"`
+}
+
+// The range of a shard group's chain covered by a period of the index. A
+// negative To means up to the present.
+type shardRange struct {
+	ShardGroup int   `json:"shard_group"`
+	From       int64 `json:"from"`
+	To         int64 `json:"to"`
+}
+
+func (db *Database) getShardIndexCollection(s *mgo.Session) *mgo.Collection {
+	return s.DB(databaseName).C(shardIndexCollName)
+}
+
+func (e *ShardIndexEntry) makeHash() string {
+	var enc canonicalEncoder
+	enc.b.WriteString(shardIndexMagic)
+	enc.writeInt64(e.Window)
+	enc.writeInt64(e.Start.UnixNano())
+	enc.writeInt64(e.End.UnixNano())
+	enc.writeString(e.PreviousHash)
+	enc.writeUint32(uint32(len(e.Shards)))
+	for _, h := range e.Shards {
+		enc.writeInt64(int64(h.ShardGroup))
+		enc.writeInt64(h.SequenceId)
+		enc.writeString(h.Hash)
+		enc.writeInt64(h.Count)
+	}
+	sum := sha256.Sum256(enc.b.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+func (e *ShardIndexEntry) head(shardGroup int) (ShardHead, bool) {
+	for _, h := range e.Shards {
+		if h.ShardGroup == shardGroup {
+			return h, true
+		}
+	}
+	return ShardHead{ShardGroup: shardGroup, SequenceId: -1}, false
+}
+
+func latestShardIndexEntry(db *Database, s *mgo.Session) (*ShardIndexEntry, bool) {
+	var e ShardIndexEntry
+	if err := db.getShardIndexCollection(s).Find(nil).Sort("-window").One(&e); err != nil {
+		if err != mgo.ErrNotFound {
+			log.Panicf("Query returned error %v\n", err)
+		}
+		return nil, false
+	}
+	return &e, true
+}
+
+// Close the current window, writing an index entry if anything was chained
+// during it
+func appendShardIndexEntry(db *Database, s *mgo.Session) {
+	e := ShardIndexEntry{
+		Start: time.Unix(0, 0),
+		// Mongo stores times to the millisecond, so only hash what we can store
+		End: time.Now().Truncate(time.Millisecond),
+	}
+	previous, havePrevious := latestShardIndexEntry(db, s)
+	if havePrevious {
+		e.Window = previous.Window + 1
+		e.Start = previous.End
+		e.PreviousHash = previous.Hash
+	}
+
+	c := db.getLogItemCollection(s)
+	changed := false
+	for _, sg := range db.shardGroups(s) {
+		h := ShardHead{ShardGroup: sg, SequenceId: -1}
+		var item LogItem
+		if err := c.Find(bson.M{"shardgroup": sg}).Sort("-sequenceid").Select(bson.M{"sequenceid": 1, "hash": 1}).One(&item); err == nil {
+			h.SequenceId = item.SequenceId
+			h.Hash = item.Hash
+		} else if err != mgo.ErrNotFound {
+			log.Panicf("Query returned error %v\n", err)
+		}
+		last := int64(-1)
+		if havePrevious {
+			p, _ := previous.head(sg)
+			last = p.SequenceId
+		}
+		if h.SequenceId < last {
+			log.Panicf("Refusing to index: shard group %d has gone back from sequence id %d to %d", sg, last, h.SequenceId)
+		}
+		h.Count = h.SequenceId - last
+		if h.Count > 0 {
+			changed = true
+		}
+		e.Shards = append(e.Shards, h)
+	}
+	if !changed {
+		// Let the window run on until something happens
+		return
+	}
+
+	e.Hash = e.makeHash()
+	if err := db.getShardIndexCollection(s).Insert(&e); err != nil {
+		log.Panicf("Could not insert shard index entry %v\n", err)
+	}
+}
+
+func shardIndexRun(db *Database) {
+	for {
+		time.Sleep(time.Duration(shardIndexInterval) * time.Second)
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("panic caught in shard index thread: %+v", err)
+				}
+			}()
+			sessionCopy := db.mongoSession.Copy()
+			defer sessionCopy.Close()
+			if holdsLease(db, sessionCopy, shardIndexLease) {
+				appendShardIndexEntry(db, sessionCopy)
+			}
+		}()
+	}
+}
+
+func startShardIndex(db *Database) {
+	if shardIndexInterval <= 0 {
+		return
+	}
+	log.Printf("Starting shard index every %d seconds\n", shardIndexInterval)
+	go shardIndexRun(db)
+}
+
+// The index entries for the windows overlapping a period. A zero until
+// means up to the present.
+func shardIndexEntriesBetween(db *Database, s *mgo.Session, since time.Time, until time.Time) []ShardIndexEntry {
+	query := bson.M{"end": bson.M{"$gt": since}}
+	if !until.IsZero() {
+		query["start"] = bson.M{"$lt": until}
+	}
+	entries := []ShardIndexEntry{}
+	if err := db.getShardIndexCollection(s).Find(query).Sort("window").All(&entries); err != nil {
+		log.Panicf("Query returned error %v\n", err)
+	}
+	return entries
+}
+
+/*
+ * The ranges of each shard group's chain which were chained during the
+ * windows overlapping a period, i.e. which shard groups had entries then.
+ * The period is rounded out to whole windows. Where it runs past the last
+ * index entry, the ranges run on to the present.
+ */
+func shardRangesBetween(db *Database, s *mgo.Session, since time.Time, until time.Time) []*shardRange {
+	ranges := make(map[int]*shardRange)
+	for _, e := range shardIndexEntriesBetween(db, s, since, until) {
+		for _, h := range e.Shards {
+			if h.Count <= 0 {
+				continue
+			}
+			if r, ok := ranges[h.ShardGroup]; ok {
+				r.To = h.SequenceId
+			} else {
+				ranges[h.ShardGroup] = &shardRange{ShardGroup: h.ShardGroup, From: h.SequenceId - h.Count + 1, To: h.SequenceId}
+			}
+		}
+	}
+
+	latest, haveLatest := latestShardIndexEntry(db, s)
+	if until.IsZero() || !haveLatest || until.After(latest.End) {
+		// Add whatever has been chained since the last window closed
+		c := db.getLogItemCollection(s)
+		for _, sg := range db.shardGroups(s) {
+			from := int64(0)
+			if haveLatest {
+				h, _ := latest.head(sg)
+				from = h.SequenceId + 1
+			}
+			n, err := c.Find(bson.M{"shardgroup": sg, "sequenceid": bson.M{"$gte": from}}).Limit(1).Count()
+			if err != nil {
+				log.Panicf("Query returned error %v\n", err)
+			}
+			if n == 0 {
+				continue
+			}
+			if r, ok := ranges[sg]; ok {
+				r.To = -1
+			} else {
+				ranges[sg] = &shardRange{ShardGroup: sg, From: from, To: -1}
+			}
+		}
+	}
+
+	result := []*shardRange{}
+	for _, r := range ranges {
+		result = append(result, r)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ShardGroup < result[j].ShardGroup })
+	return result
+}
+
+// A query matching the items in a set of shard ranges
+func shardRangeQuery(ranges []*shardRange) interface{} {
+	if len(ranges) == 0 {
+		return bson.M{"shardgroup": bson.M{"$in": []int{}}}
+	}
+	clauses := make([]interface{}, len(ranges))
+	for i, r := range ranges {
+		seqQuery := bson.M{"$gte": r.From}
+		if r.To >= 0 {
+			seqQuery["$lte"] = r.To
+		}
+		clauses[i] = bson.M{"shardgroup": r.ShardGroup, "sequenceid": seqQuery}
+	}
+	return bson.M{"$or": clauses}
+}
+
+type shardIndexReport struct {
+	Shards  []*shardRange     `json:"shards"`
+	Windows []ShardIndexEntry `json:"windows"`
+	Intact  bool              `json:"intact"`
+}
+
+// Report which shard groups had entries during a period, together with the
+// index entries covering it and whether those verify
+func queryShardIndex(db *Database, since time.Time, until time.Time) *shardIndexReport {
+	sessionCopy := db.mongoSession.Copy()
+	defer sessionCopy.Close()
+
+	report := &shardIndexReport{
+		Shards:  shardRangesBetween(db, sessionCopy, since, until),
+		Windows: shardIndexEntriesBetween(db, sessionCopy, since, until),
+		Intact:  true,
+	}
+	for i := range report.Windows {
+		e := &report.Windows[i]
+		if e.makeHash() != e.Hash {
+			report.Intact = false
+		}
+		if i > 0 && (e.Window != report.Windows[i-1].Window+1 || e.PreviousHash != report.Windows[i-1].Hash) {
+			report.Intact = false
+		}
+	}
+	return report
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+/*
+ * Decoding of the snappy block format (not the framed stream format), as
+ * used to compress Loki and Prometheus remote write requests. A block is
+ * the decoded length as a varint followed by elements, each a literal or
+ * a copy of earlier output, distinguished by the low two bits of the tag
+ * byte.
+ */
+
+var errSnappyCorrupt = errors.New("snappy data corrupt")
+
+func snappyDecode(src []byte, max int) ([]byte, error) {
+	n, i := binary.Uvarint(src)
+	if i <= 0 {
+		return nil, errSnappyCorrupt
+	}
+	if n > uint64(max) {
+		return nil, errors.New("snappy data too long")
+	}
+	src = src[i:]
+	// The header's length is only a claim, so start no larger than the data
+	// could plausibly expand to, and grow as elements arrive
+	capacity := n
+	if limit := uint64(len(src)) * 4; capacity > limit {
+		capacity = limit
+	}
+	dst := make([]byte, 0, capacity)
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			// Literal, its length less one in the upper six bits, or in
+			// the following 1 to 4 bytes
+			length = int(tag >> 2)
+			src = src[1:]
+			if length >= 60 {
+				extra := length - 59
+				if len(src) < extra {
+					return nil, errSnappyCorrupt
+				}
+				var l uint64
+				for j := extra - 1; j >= 0; j-- {
+					l = l<<8 | uint64(src[j])
+				}
+				if l >= uint64(max) {
+					return nil, errSnappyCorrupt
+				}
+				length = int(l)
+				src = src[extra:]
+			}
+			length++
+			if len(src) < length || len(dst)+length > int(n) {
+				return nil, errSnappyCorrupt
+			}
+			dst = append(dst, src[:length]...)
+			src = src[length:]
+			continue
+		case 1:
+			if len(src) < 2 {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2)&7
+			offset = int(tag&0xe0)<<3 | int(src[1])
+			src = src[2:]
+		case 2:
+			if len(src) < 3 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[1:3]))
+			src = src[3:]
+		case 3:
+			if len(src) < 5 {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[1:5]))
+			src = src[5:]
+		}
+		if offset <= 0 || offset > len(dst) || len(dst)+length > int(n) {
+			return nil, errSnappyCorrupt
+		}
+		// Copies may overlap their own output, so go a byte at a time
+		for j := 0; j < length; j++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+	if len(dst) != int(n) {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
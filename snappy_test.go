@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"runtime"
+	"testing"
+)
+
+// A literal element holding b
+func snappyTestLiteral(b []byte) []byte {
+	switch n := len(b) - 1; {
+	case n < 60:
+		return append([]byte{byte(n) << 2}, b...)
+	case n < 1<<8:
+		return append([]byte{60 << 2, byte(n)}, b...)
+	default:
+		return append([]byte{61 << 2, byte(n), byte(n >> 8)}, b...)
+	}
+}
+
+// A block of the given elements, decoding to n bytes
+func snappyTestBlock(n uint64, elements ...[]byte) []byte {
+	return protoTestCat(append([][]byte{protoTestVarint(n)}, elements...)...)
+}
+
+func TestSnappyDecode(t *testing.T) {
+	long := bytes.Repeat([]byte("0123456789"), 100)
+	for _, tc := range []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"empty", snappyTestBlock(0), ""},
+		{"literal", snappyTestBlock(3, snappyTestLiteral([]byte("abc"))), "abc"},
+		{"one byte literal length", snappyTestBlock(200, snappyTestLiteral(long[:200])), string(long[:200])},
+		{"two byte literal length", snappyTestBlock(1000, snappyTestLiteral(long)), string(long)},
+		{"one and two byte offset copies", snappyTestBlock(15, snappyTestLiteral([]byte("abcd")),
+			[]byte{1 | (8-4)<<2, 4}, []byte{2 | (3-1)<<2, 2, 0}), "abcdabcdabcdcdc"},
+		{"four byte offset copy", snappyTestBlock(6, snappyTestLiteral([]byte("ab")), []byte{3 | (4-1)<<2, 2, 0, 0, 0}), "ababab"},
+		{"overlapping copy", snappyTestBlock(10, snappyTestLiteral([]byte("a")), []byte{2 | (9-1)<<2, 1, 0}), "aaaaaaaaaa"},
+		{"one byte offset copy beyond 255", snappyTestBlock(260, snappyTestLiteral(long[:256]), []byte{1 | (4-4)<<2 | 1<<5, 0}),
+			string(long[:256]) + string(long[:4])},
+	} {
+		got, err := snappyDecode(tc.in, 1<<20)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if string(got) != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSnappyDecodeMalformed(t *testing.T) {
+	a := snappyTestLiteral([]byte("a"))
+	for _, tc := range []struct {
+		name string
+		in   []byte
+	}{
+		{"empty", nil},
+		{"truncated length", []byte{0x80}},
+		{"longer than the maximum", snappyTestBlock(101, snappyTestLiteral(make([]byte, 101)))},
+		{"huge length", snappyTestBlock(1<<64-1, a)},
+		{"claimed length with no data", snappyTestBlock(100)},
+		{"short literal", snappyTestBlock(10, []byte{9 << 2, 'a'})},
+		{"literal past the length", snappyTestBlock(1, snappyTestLiteral([]byte("ab")))},
+		{"truncated literal length", snappyTestBlock(70, []byte{60 << 2})},
+		{"huge literal length", snappyTestBlock(5, []byte{63 << 2, 0xff, 0xff, 0xff, 0xff, 'a'})},
+		{"output too short", snappyTestBlock(4, snappyTestLiteral([]byte("abc")))},
+		{"truncated one byte offset copy", snappyTestBlock(5, a, []byte{1})},
+		{"truncated two byte offset copy", snappyTestBlock(5, a, []byte{2, 1})},
+		{"truncated four byte offset copy", snappyTestBlock(5, a, []byte{3, 1, 0, 0})},
+		{"zero offset", snappyTestBlock(5, a, []byte{1, 0})},
+		{"offset before the start", snappyTestBlock(5, a, []byte{1, 2})},
+		{"huge offset", snappyTestBlock(5, a, []byte{3, 0xff, 0xff, 0xff, 0xff})},
+		{"copy past the length", snappyTestBlock(3, a, []byte{1 | (8-4)<<2, 1})},
+		{"copy before any output", snappyTestBlock(4, []byte{1, 1})},
+	} {
+		if got, err := snappyDecode(tc.in, 100); err == nil {
+			t.Errorf("%s: decoded as %q", tc.name, got)
+		}
+	}
+}
+
+// A small block claiming a large length is rejected without allocating it
+func TestSnappyDecodeClaimedLength(t *testing.T) {
+	in := snappyTestBlock(1<<30, snappyTestLiteral([]byte("a")))
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if _, err := snappyDecode(in, 1<<30); err != errSnappyCorrupt {
+		t.Errorf("error %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes", allocated)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+/*
+ * RFC 5424 structured data. Each SD-ELEMENT is kept, in the order
+ * received, with its params in the order received, so that the canonical
+ * hash covers exactly what was sent.
+ *
+ * Of the well-known SD-IDs (RFC 5424 section 7), [origin ip=...] supplies
+ * the hostname if the message had none. The rest, such as [meta
+ * sequenceId=...], have no corresponding field so are only kept here.
+ *
+ * Structured data may be queried with keys of the form "sd.ID.PARAM",
+ * matching items with an element ID having a param PARAM of the given value
+ * (which may use the relational and list operators as for other fields).
+ * The ID extends to the first dot.
+ */
+
+type SDParam struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type SDElement struct {
+	Id     string    `json:"id"`
+	Params []SDParam `json:"params"`
+}
+
+const sdQueryPrefix = "sd."
+
+// The value of the first param with a given name in the first element with
+// a given id
+func (l *LogItem) sdParam(id string, name string) (string, bool) {
+	for _, e := range l.StructuredData {
+		if e.Id != id {
+			continue
+		}
+		for _, p := range e.Params {
+			if p.Name == name {
+				return p.Value, true
+			}
+		}
+	}
+	return "", false
+}
+
+// Parse the STRUCTURED-DATA part of an RFC 5424 message
+func parseStructuredData(s string) ([]SDElement, error) {
+	if s == "" || s == "-" {
+		return nil, nil
+	}
+	var elements []SDElement
+	for len(s) > 0 {
+		if s[0] != '[' {
+			return nil, errors.New("SD-ELEMENT must start with '['")
+		}
+		s = s[1:]
+		var e SDElement
+		e.Id, s = sdName(s)
+		if e.Id == "" {
+			return nil, errors.New("missing SD-ID")
+		}
+		for len(s) > 0 && s[0] == ' ' {
+			var p SDParam
+			p.Name, s = sdName(s[1:])
+			if p.Name == "" || len(s) < 2 || s[0] != '=' || s[1] != '"' {
+				return nil, errors.New("bad SD-PARAM in " + e.Id)
+			}
+			s = s[2:]
+			var value []byte
+			for {
+				if len(s) == 0 {
+					return nil, errors.New("unterminated PARAM-VALUE in " + e.Id)
+				}
+				c := s[0]
+				s = s[1:]
+				if c == '"' {
+					break
+				}
+				// Only '"', '\' and ']' are escaped; any other backslash is literal
+				if c == '\\' && len(s) > 0 && (s[0] == '"' || s[0] == '\\' || s[0] == ']') {
+					c = s[0]
+					s = s[1:]
+				}
+				value = append(value, c)
+			}
+			p.Value = string(value)
+			e.Params = append(e.Params, p)
+		}
+		if len(s) == 0 || s[0] != ']' {
+			return nil, errors.New("SD-ELEMENT " + e.Id + " must end with ']'")
+		}
+		s = s[1:]
+		elements = append(elements, e)
+	}
+	return elements, nil
+}
+
+// Split an SD-NAME off the front of a string
+func sdName(s string) (string, string) {
+	i := strings.IndexAny(s, "= ]\"")
+	if i < 0 {
+		i = len(s)
+	}
+	return s[:i], s[i:]
+}
+
+// Fill in fields from the well-known SD-IDs and PROCID where they were not
+// otherwise supplied
+func (l *LogItem) mapStructuredData() {
+	if l.Hostname == "" {
+		if ip, ok := l.sdParam("origin", "ip"); ok {
+			l.Hostname = ip
+		}
+	}
+	if l.Pid == 0 && l.ProcId != "" {
+		if pid, err := strconv.Atoi(l.ProcId); err == nil {
+			l.Pid = pid
+		}
+	}
+}
+
+// Translate an "sd.ID.PARAM" query key into a query on the structured data
+func sdQuery(k string, v interface{}) (interface{}, bool) {
+	if !strings.HasPrefix(k, sdQueryPrefix) {
+		return nil, false
+	}
+	path := strings.SplitN(strings.TrimPrefix(k, sdQueryPrefix), ".", 2)
+	if len(path) != 2 || path[0] == "" || path[1] == "" {
+		return nil, false
+	}
+	return map[string]interface{}{
+		"$elemMatch": map[string]interface{}{
+			"id": path[0],
+			"params": map[string]interface{}{
+				"$elemMatch": map[string]interface{}{"name": path[1], "value": v},
+			},
+		},
+	}, true
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseStructuredData(t *testing.T) {
+	for _, tc := range []struct {
+		in   string
+		want []SDElement
+	}{
+		{"", nil},
+		{"-", nil},
+		{"[a]", []SDElement{{Id: "a"}}},
+		{`[exampleSDID@32473 iut="3" eventSource="Application" eventID="1011"]`, []SDElement{
+			{Id: "exampleSDID@32473", Params: []SDParam{{"iut", "3"}, {"eventSource", "Application"}, {"eventID", "1011"}}},
+		}},
+		{`[a x="1"][b][a x="2"]`, []SDElement{
+			{Id: "a", Params: []SDParam{{"x", "1"}}},
+			{Id: "b"},
+			{Id: "a", Params: []SDParam{{"x", "2"}}},
+		}},
+		{`[a x=""]`, []SDElement{{Id: "a", Params: []SDParam{{"x", ""}}}}},
+		// Only '"', '\' and ']' are escaped
+		{`[a x="q\"b\\s\]c\e"]`, []SDElement{{Id: "a", Params: []SDParam{{"x", `q"b\s]c\e`}}}}},
+		{`[a x="ü [ ="]`, []SDElement{{Id: "a", Params: []SDParam{{"x", "ü [ ="}}}}},
+		{`[a x="1" x="2"]`, []SDElement{{Id: "a", Params: []SDParam{{"x", "1"}, {"x", "2"}}}}},
+	} {
+		got, err := parseStructuredData(tc.in)
+		if err != nil {
+			t.Errorf("%q: %v", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%q: got %+v, want %+v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestParseStructuredDataMalformed(t *testing.T) {
+	for _, in := range []string{
+		"x",
+		"[",
+		"[a",
+		"[]",
+		"[ x=\"1\"]",
+		"[a]x",
+		"[a] [b]",
+		`[a x]`,
+		`[a x=]`,
+		`[a x=1]`,
+		`[a ="1"]`,
+		`[a x="1`,
+		`[a x="1\"]`,
+		`[a x="1"`,
+		`[a x="1"x="2"]`,
+		`[a x="1"]]`,
+		`[a x="1" ]`,
+		"-x",
+	} {
+		if got, err := parseStructuredData(in); err == nil {
+			t.Errorf("%q: accepted as %+v", in, got)
+		}
+	}
+}
+
+// Many elements should parse without trouble
+func TestParseStructuredDataLong(t *testing.T) {
+	in := strings.Repeat(`[a x="1" y="2"]`, 10000)
+	got, err := parseStructuredData(in)
+	if err != nil || len(got) != 10000 {
+		t.Fatalf("got %d elements, %v", len(got), err)
+	}
+	if _, err := parseStructuredData(in[:len(in)-1]); err == nil {
+		t.Error("truncated structured data accepted")
+	}
+}
+
+func TestMapStructuredData(t *testing.T) {
+	origin := []SDElement{{Id: "origin", Params: []SDParam{{"ip", "192.0.2.1"}}}}
+	for _, tc := range []struct {
+		name     string
+		item     LogItem
+		hostname string
+		pid      int
+	}{
+		{"origin ip", LogItem{StructuredData: origin}, "192.0.2.1", 0},
+		{"hostname kept", LogItem{Hostname: "h", StructuredData: origin}, "h", 0},
+		{"procid", LogItem{ProcId: "42"}, "", 42},
+		{"pid kept", LogItem{Pid: 7, ProcId: "42"}, "", 7},
+		{"non-numeric procid", LogItem{ProcId: "worker"}, "", 0},
+	} {
+		tc.item.mapStructuredData()
+		if tc.item.Hostname != tc.hostname || tc.item.Pid != tc.pid {
+			t.Errorf("%s: hostname %q pid %d, want %q and %d", tc.name, tc.item.Hostname, tc.item.Pid, tc.hostname, tc.pid)
+		}
+	}
+}
+
+func TestSdQuery(t *testing.T) {
+	for _, tc := range []struct {
+		key string
+		ok  bool
+	}{
+		{"sd.origin.ip", true},
+		{"sd.meta.sequenceId", true},
+		{"sd.a.b.c", true},
+		{"sd.origin", false},
+		{"sd..ip", false},
+		{"sd.origin.", false},
+		{"hostname", false},
+	} {
+		if _, ok := sdQuery(tc.key, "v"); ok != tc.ok {
+			t.Errorf("%s: ok = %v, want %v", tc.key, ok, tc.ok)
+		}
+	}
+	got, _ := sdQuery("sd.a.b.c", "v")
+	want := map[string]interface{}{
+		"$elemMatch": map[string]interface{}{
+			"id": "a",
+			"params": map[string]interface{}{
+				"$elemMatch": map[string]interface{}{"name": "b.c", "value": "v"},
+			},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sd.a.b.c: got %v, want %v", got, want)
+	}
+}
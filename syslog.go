@@ -27,6 +27,14 @@ func getPartString(logParts *syslogparser.LogParts, key string) (string, bool) {
 	return "", false
 }
 
+// As getPartString, treating the RFC 5424 NILVALUE as absent
+func getPartNilString(logParts *syslogparser.LogParts, key string) (string, bool) {
+	if s, ok := getPartString(logParts, key); ok && s != "-" && s != "" {
+		return s, true
+	}
+	return "", false
+}
+
 func getPartInt(logParts *syslogparser.LogParts, key string) (int, bool) {
 	if _, ok := (*logParts)[key]; !ok {
 		return 0, false
@@ -67,12 +75,24 @@ func getPartTime(logParts *syslogparser.LogParts, key string) (time.Time, bool)
 	return time.Time{}, false
 }
 
-func processLogParts(db *Database, logParts syslogparser.LogParts) {
+// Chain a batch of syslog messages received on a listener, returning an
+// error if they could not all be committed
+func processLogParts(db *Database, batch []syslogparser.LogParts, listener string) (err error) {
 	defer func() {
-		if err := recover(); err != nil {
-			log.Printf("panic caught: %+v", err)
+		if r := recover(); r != nil {
+			log.Printf("panic caught: %+v", r)
+			err = fmt.Errorf("%v", r)
 		}
 	}()
+	items := make([]*LogItem, len(batch))
+	for i := range batch {
+		items[i] = logItemFromParts(batch[i], listener)
+	}
+	insertLogItems(db, items)
+	return nil
+}
+
+func logItemFromParts(logParts syslogparser.LogParts, listener string) *LogItem {
 	var logItem LogItem
 	if client, ok := getPartString(&logParts, "client"); ok {
 		if host, port, err := net.SplitHostPort(client); err == nil {
@@ -91,9 +111,28 @@ func processLogParts(db *Database, logParts syslogparser.LogParts) {
 	if facility, ok := getPartInt(&logParts, "facility"); ok {
 		logItem.Facility = facilityToString(facility)
 	}
-	if hostname, ok := getPartString(&logParts, "hostname"); ok {
+	if hostname, ok := getPartNilString(&logParts, "hostname"); ok {
 		logItem.Hostname = hostname
 	}
+	if appName, ok := getPartNilString(&logParts, "app_name"); ok {
+		logItem.AppName = appName
+	}
+	if procId, ok := getPartNilString(&logParts, "proc_id"); ok {
+		logItem.ProcId = procId
+	}
+	if msgId, ok := getPartNilString(&logParts, "msg_id"); ok {
+		logItem.MsgId = msgId
+	}
+	unparsed := ""
+	if sd, ok := getPartNilString(&logParts, "structured_data"); ok {
+		if elements, err := parseStructuredData(sd); err == nil {
+			logItem.StructuredData = elements
+		} else {
+			// Keep it in the message rather than lose it
+			log.Printf("Cannot parse structured data: %v\n", err)
+			unparsed = sd + " "
+		}
+	}
 	if clientname, ok := getPartString(&logParts, "tls_peer"); ok {
 		logItem.ClientName = clientname
 	}
@@ -126,18 +165,29 @@ func processLogParts(db *Database, logParts syslogparser.LogParts) {
 				logItem.Message = msg
 			}
 		}
+	} else if msg, ok := getPartString(&logParts, "message"); ok {
+		// RFC 5424 has no tag
+		if strings.Contains(msg, "{") {
+			if err := json.Unmarshal([]byte(msg), &logItem); err != nil {
+				logItem.Message = msg
+			}
+		} else {
+			logItem.Message = msg
+		}
 	} else {
 		if tag, ok := getPartString(&logParts, "tag"); ok {
 			logItem.Message = tag
 		}
 	}
+	logItem.Message = unparsed + logItem.Message
 	// override any supplied rx time - we keep the originator time
 	logItem.Time = time.Now()
 	logItem.normalise()
-	logItem.makeHashAndInsert(db)
+	logItem.assignShardGroup(listener)
+	return &logItem
 }
 
-func syslogServerRun(server *syslog.Server, db *Database) {
+func syslogServerRun(server *syslog.Server, db *Database, listener string) {
 	server.SetFormat(syslog.Automatic)
 	channel := make(syslog.LogPartsChannel)
 	handler := syslog.NewChannelHandler(channel)
@@ -147,7 +197,19 @@ func syslogServerRun(server *syslog.Server, db *Database) {
 
 	go func(channel syslog.LogPartsChannel) {
 		for logParts := range channel {
-			processLogParts(db, logParts)
+			// Pass on whatever else has arrived in the meantime as one
+			// batch, so it can be group committed
+			batch := []syslogparser.LogParts{logParts}
+		gather:
+			for len(batch) < ingestBatchSize {
+				select {
+				case logParts := <-channel:
+					batch = append(batch, logParts)
+				default:
+					break gather
+				}
+			}
+			processLogParts(db, batch, listener)
 		}
 	}(channel)
 